@@ -0,0 +1,206 @@
+// Package alarm evaluates the alarm conditions of the subscriptions
+package alarm
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tommyblue/her/her"
+)
+
+// Condition is a validated alarm condition, ready to be evaluated
+type Condition struct {
+	conf her.AlarmConf
+	re   *regexp.Regexp
+	// relaxed has the thresholds moved by the hysteresis, it's evaluated while the alarm is active
+	relaxed her.AlarmConf
+}
+
+// CompileAll validates the alarms of a subscription, whose names must be unique
+func CompileAll(confs []her.AlarmConf) ([]*Condition, error) {
+	names := make(map[string]bool)
+	conditions := make([]*Condition, 0, len(confs))
+	for _, conf := range confs {
+		if names[conf.Name] {
+			return nil, fmt.Errorf("duplicated alarm name %s", conf.Name)
+		}
+		names[conf.Name] = true
+
+		c, err := Compile(conf)
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, c)
+	}
+	return conditions, nil
+}
+
+// Compile validates the alarm configuration. The errors name the alarm, or its operator if unnamed
+func Compile(conf her.AlarmConf) (*Condition, error) {
+	name := conf.Name
+	if name == "" {
+		name = conf.Operator
+	}
+	prefix := strings.TrimSpace("alarm " + name)
+	fail := func(format string, a ...interface{}) error {
+		return fmt.Errorf(prefix+": "+format, a...)
+	}
+
+	if conf.Severity != "" && her.SeverityRank(conf.Severity) < 0 {
+		return nil, fail("unknown severity %s", conf.Severity)
+	}
+	if conf.Hysteresis < 0 {
+		return nil, fail("negative hysteresis")
+	}
+	if conf.For < 0 {
+		return nil, fail("negative duration")
+	}
+	if conf.Window != 0 && !RateOperator(conf.Operator) {
+		return nil, fail("window is only for rises_by and falls_by")
+	}
+	c := &Condition{conf: conf, relaxed: conf}
+	switch conf.Operator {
+	case "greater_than", "less_than", "equal_to", "not_equal", "greater_or_equal", "less_or_equal":
+	case "between", "outside":
+		if conf.Min > conf.Max {
+			return nil, fail("min %v is greater than max %v", conf.Min, conf.Max)
+		}
+		if conf.Operator == "outside" && conf.Min+2*conf.Hysteresis > conf.Max {
+			return nil, fail("hysteresis %v is larger than the range", conf.Hysteresis)
+		}
+	case "rises_by", "falls_by":
+		if conf.Window <= 0 {
+			return nil, fail("missing window")
+		}
+		if conf.Value <= 0 {
+			return nil, fail("the change must be positive")
+		}
+	case "equals":
+	case "contains":
+		if conf.Text == "" {
+			return nil, fail("missing text")
+		}
+	case "matches":
+		re, err := regexp.Compile(conf.Text)
+		if err != nil {
+			return nil, fail("%w", err)
+		}
+		c.re = re
+	case "":
+		return nil, fail("missing operator")
+	default:
+		return nil, fail("unknown operator %s", conf.Operator)
+	}
+
+	h := conf.Hysteresis
+	switch conf.Operator {
+	case "greater_than", "greater_or_equal", "rises_by", "falls_by":
+		c.relaxed.Value -= h
+	case "less_than", "less_or_equal":
+		c.relaxed.Value += h
+	case "between":
+		c.relaxed.Min -= h
+		c.relaxed.Max += h
+	case "outside":
+		c.relaxed.Min += h
+		c.relaxed.Max -= h
+	}
+	return c, nil
+}
+
+// Evaluate returns the new state of the alarm. An active alarm stays active until the value moves
+// past the threshold by the hysteresis
+func (c *Condition) Evaluate(value string, active bool) (bool, error) {
+	if active {
+		return evaluate(c.relaxed, c.re, value)
+	}
+	return evaluate(c.conf, c.re, value)
+}
+
+// Numeric reports whether the condition compares numbers
+func (c *Condition) Numeric() bool {
+	return NumericOperator(c.conf.Operator)
+}
+
+// NumericOperator reports whether the operator compares numbers, rather than strings
+func NumericOperator(operator string) bool {
+	switch operator {
+	case "equals", "contains", "matches":
+		return false
+	}
+	return true
+}
+
+// RateOperator reports whether the operator compares the change of the value over a window. The
+// value evaluated by these operators is the change returned by Change
+func RateOperator(operator string) bool {
+	return operator == "rises_by" || operator == "falls_by"
+}
+
+// Window returns the period of the rate operators, zero for the others
+func (c *Condition) Window() time.Duration {
+	return c.conf.Window
+}
+
+// Change returns how much the value changed compared with the values recorded in the window: the
+// rise from the lowest one for rises_by, the fall from the highest one, negative, for falls_by
+func Change(operator string, value float64, previous []float64) float64 {
+	change := 0.0
+	for _, p := range previous {
+		switch {
+		case operator == "rises_by" && value-p > change:
+			change = value - p
+		case operator == "falls_by" && value-p < change:
+			change = value - p
+		}
+	}
+	return change
+}
+
+// Triggered evaluates the condition, ignoring the hysteresis. Numeric operators need a number,
+// string operators compare the value as received
+func (c *Condition) Triggered(value string) (bool, error) {
+	return evaluate(c.conf, c.re, value)
+}
+
+func evaluate(conf her.AlarmConf, re *regexp.Regexp, value string) (bool, error) {
+	switch conf.Operator {
+	case "equals":
+		return strings.TrimSpace(value) == conf.Text, nil
+	case "contains":
+		return strings.Contains(value, conf.Text), nil
+	case "matches":
+		return re.MatchString(value), nil
+	}
+
+	v, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil {
+		return false, fmt.Errorf("cannot convert to a number the value %s", value)
+	}
+	switch conf.Operator {
+	case "greater_than":
+		return v > conf.Value, nil
+	case "less_than":
+		return v < conf.Value, nil
+	case "equal_to":
+		return v == conf.Value, nil
+	case "not_equal":
+		return v != conf.Value, nil
+	case "greater_or_equal":
+		return v >= conf.Value, nil
+	case "less_or_equal":
+		return v <= conf.Value, nil
+	case "between":
+		return v >= conf.Min && v <= conf.Max, nil
+	case "outside":
+		return v < conf.Min || v > conf.Max, nil
+	case "rises_by":
+		return v >= conf.Value, nil
+	case "falls_by":
+		return -v >= conf.Value, nil
+	}
+	return false, fmt.Errorf("unknown alarm operator %s", conf.Operator)
+}
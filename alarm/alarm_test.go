@@ -0,0 +1,165 @@
+package alarm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tommyblue/her/her"
+)
+
+func TestTriggered(t *testing.T) {
+	tests := []struct {
+		name    string
+		conf    her.AlarmConf
+		value   string
+		want    bool
+		wantErr bool
+	}{
+		{"greater_than", her.AlarmConf{Operator: "greater_than", Value: 20}, "20.5", true, false},
+		{"greater_than equal", her.AlarmConf{Operator: "greater_than", Value: 20}, "20", false, false},
+		{"greater_or_equal", her.AlarmConf{Operator: "greater_or_equal", Value: 20}, "20", true, false},
+		{"less_than", her.AlarmConf{Operator: "less_than", Value: 20}, "19", true, false},
+		{"less_or_equal", her.AlarmConf{Operator: "less_or_equal", Value: 20}, "20.1", false, false},
+		{"equal_to", her.AlarmConf{Operator: "equal_to", Value: 1}, "1.0", true, false},
+		{"not_equal", her.AlarmConf{Operator: "not_equal", Value: 1}, "0", true, false},
+		{"between", her.AlarmConf{Operator: "between", Min: 18, Max: 24}, "24", true, false},
+		{"between outside", her.AlarmConf{Operator: "between", Min: 18, Max: 24}, "25", false, false},
+		{"outside", her.AlarmConf{Operator: "outside", Min: 18, Max: 24}, "17.9", true, false},
+		{"outside inside", her.AlarmConf{Operator: "outside", Min: 18, Max: 24}, "18", false, false},
+		{"not a number", her.AlarmConf{Operator: "greater_than", Value: 20}, "OPEN", false, true},
+		{"equals", her.AlarmConf{Operator: "equals", Text: "OPEN"}, "OPEN\n", true, false},
+		{"equals case", her.AlarmConf{Operator: "equals", Text: "OPEN"}, "open", false, false},
+		{"contains", her.AlarmConf{Operator: "contains", Text: `"status":"error"`}, `{"status":"error"}`, true, false},
+		{"matches", her.AlarmConf{Operator: "matches", Text: `"status":\s*"(error|fault)"`}, `{"status": "fault"}`, true, false},
+		{"not matches", her.AlarmConf{Operator: "matches", Text: `^ERR`}, "OK", false, false},
+		{"rises_by", her.AlarmConf{Operator: "rises_by", Value: 5, Window: time.Minute}, "5", true, false},
+		{"rises_by less", her.AlarmConf{Operator: "rises_by", Value: 5, Window: time.Minute}, "4.9", false, false},
+		{"falls_by", her.AlarmConf{Operator: "falls_by", Value: 5, Window: time.Minute}, "-6", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := Compile(tt.conf)
+			if err != nil {
+				t.Fatalf("Unexpected error %v", err)
+			}
+			got, err := c.Triggered(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Triggered() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Triggered(%q) = %v, want %v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompile(t *testing.T) {
+	tests := []struct {
+		name string
+		conf her.AlarmConf
+		want string
+	}{
+		{"missing operator", her.AlarmConf{Value: 20}, "alarm: missing operator"},
+		{"unknown operator", her.AlarmConf{Operator: "bigger_than"}, "alarm bigger_than: unknown operator bigger_than"},
+		{"inverted range", her.AlarmConf{Operator: "outside", Min: 10, Max: 5}, "alarm outside: min 10 is greater than max 5"},
+		{"empty contains", her.AlarmConf{Operator: "contains"}, "alarm contains: missing text"},
+		{"invalid regexp", her.AlarmConf{Operator: "matches", Text: "[a-"}, "alarm matches: error parsing regexp: missing closing ]: `[a-`"},
+		{"negative hysteresis", her.AlarmConf{Name: "frost", Operator: "less_than", Hysteresis: -1}, "alarm frost: negative hysteresis"},
+		{"hysteresis larger than the range", her.AlarmConf{Operator: "outside", Min: 10, Max: 12, Hysteresis: 2}, "alarm outside: hysteresis 2 is larger than the range"},
+		{"rises_by without window", her.AlarmConf{Name: "surge", Operator: "rises_by", Value: 5}, "alarm surge: missing window"},
+		{"falls_by without change", her.AlarmConf{Operator: "falls_by", Window: time.Minute}, "alarm falls_by: the change must be positive"},
+		{"window of a threshold", her.AlarmConf{Name: "hot", Operator: "greater_than", Value: 5, Window: time.Minute}, "alarm hot: window is only for rises_by and falls_by"},
+		{"unknown severity", her.AlarmConf{Name: "hot", Operator: "greater_than", Severity: "fatal"}, "alarm hot: unknown severity fatal"},
+		{"named without operator", her.AlarmConf{Name: "hot", Value: 20}, "alarm hot: missing operator"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Compile(tt.conf); err == nil || err.Error() != tt.want {
+				t.Errorf("got error %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestEvaluateHysteresis(t *testing.T) {
+	tests := []struct {
+		name   string
+		conf   her.AlarmConf
+		values []string
+		want   []bool
+	}{
+		{
+			"greater_than",
+			her.AlarmConf{Operator: "greater_than", Value: 20, Hysteresis: 0.5},
+			[]string{"19.9", "20.1", "20.3", "19.8", "19.5", "20"},
+			[]bool{false, true, true, true, false, false},
+		},
+		{
+			"less_than",
+			her.AlarmConf{Operator: "less_than", Value: 10, Hysteresis: 1},
+			[]string{"9", "10.5", "11.1"},
+			[]bool{true, true, false},
+		},
+		{
+			"between",
+			her.AlarmConf{Operator: "between", Min: 10, Max: 20, Hysteresis: 2},
+			[]string{"15", "21", "22.5"},
+			[]bool{true, true, false},
+		},
+		{
+			"outside",
+			her.AlarmConf{Operator: "outside", Min: 10, Max: 20, Hysteresis: 2},
+			[]string{"21", "19", "17"},
+			[]bool{true, true, false},
+		},
+		{
+			"without hysteresis",
+			her.AlarmConf{Operator: "greater_than", Value: 20},
+			[]string{"21", "20"},
+			[]bool{true, false},
+		},
+		{
+			"string operators ignore it",
+			her.AlarmConf{Operator: "equals", Text: "OPEN", Hysteresis: 1},
+			[]string{"OPEN", "CLOSED"},
+			[]bool{true, false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := Compile(tt.conf)
+			if err != nil {
+				t.Fatalf("Unexpected error %v", err)
+			}
+			active := false
+			for i, v := range tt.values {
+				if active, err = c.Evaluate(v, active); err != nil {
+					t.Fatalf("Unexpected error %v", err)
+				}
+				if active != tt.want[i] {
+					t.Errorf("value %s: got %v, want %v", v, active, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestChange(t *testing.T) {
+	tests := []struct {
+		operator string
+		value    float64
+		previous []float64
+		want     float64
+	}{
+		{"rises_by", 25, []float64{20, 18, 22}, 7},
+		{"rises_by", 17, []float64{20, 18}, 0},
+		{"falls_by", 15, []float64{20, 18, 22}, -7},
+		{"falls_by", 25, []float64{20}, 0},
+		{"rises_by", 25, nil, 0},
+	}
+	for _, tt := range tests {
+		if got := Change(tt.operator, tt.value, tt.previous); got != tt.want {
+			t.Errorf("Change(%s, %v, %v) = %v, want %v", tt.operator, tt.value, tt.previous, got, tt.want)
+		}
+	}
+}
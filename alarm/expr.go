@@ -0,0 +1,155 @@
+package alarm
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/tommyblue/her/her"
+)
+
+// Expr is a validated composite condition, ready to be evaluated
+type Expr struct {
+	and   []*Expr
+	or    []*Expr
+	not   *Expr
+	topic string
+	leaf  *Condition
+}
+
+// Value is the current value of a topic, as compared by the alarms: the raw payload by the string
+// operators and the payload after scale and offset, not rounded, by the numeric ones
+type Value struct {
+	Raw       string
+	Converted string
+}
+
+// CompileCondition validates the condition, its expression and its alarm
+func CompileCondition(conf her.ConditionConf) (*Expr, error) {
+	if conf.Name == "" {
+		return nil, errors.New("condition without name")
+	}
+	expr, err := CompileExpr(conf.When)
+	if err != nil {
+		return nil, fmt.Errorf("condition %s: %w", conf.Name, err)
+	}
+	if _, err := CompileAll(conf.Subscription().AlarmConfs()); err != nil {
+		return nil, fmt.Errorf("condition %s: %w", conf.Name, err)
+	}
+	return expr, nil
+}
+
+// CompileExpr validates the expression. Every node must be either an and, an or, a not or the
+// comparison of a topic. Topics of other conditions can't be compared, to avoid loops
+func CompileExpr(conf her.ExprConf) (*Expr, error) {
+	kinds := 0
+	for _, set := range []bool{len(conf.And) > 0, len(conf.Or) > 0, conf.Not != nil, conf.Topic != ""} {
+		if set {
+			kinds++
+		}
+	}
+	if kinds != 1 {
+		return nil, errors.New("each node needs exactly one of a non empty and, or, not and topic")
+	}
+
+	e := &Expr{topic: conf.Topic}
+	var err error
+	switch {
+	case len(conf.And) > 0:
+		e.and, err = compileExprs(conf.And)
+	case len(conf.Or) > 0:
+		e.or, err = compileExprs(conf.Or)
+	case conf.Not != nil:
+		e.not, err = CompileExpr(*conf.Not)
+	default:
+		if strings.HasPrefix(conf.Topic, her.ConditionKey("")) {
+			return nil, fmt.Errorf("topic %s: conditions can't depend on other conditions", conf.Topic)
+		}
+		if RateOperator(conf.Operator) {
+			return nil, fmt.Errorf("topic %s: %s compares the history, not the current value", conf.Topic, conf.Operator)
+		}
+		e.leaf, err = Compile(her.AlarmConf{
+			Operator: conf.Operator,
+			Value:    conf.Value,
+			Min:      conf.Min,
+			Max:      conf.Max,
+			Text:     conf.Text,
+		})
+		if err != nil {
+			err = fmt.Errorf("topic %s: %w", conf.Topic, err)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func compileExprs(confs []her.ExprConf) ([]*Expr, error) {
+	exprs := make([]*Expr, 0, len(confs))
+	for _, conf := range confs {
+		e, err := CompileExpr(conf)
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, e)
+	}
+	return exprs, nil
+}
+
+// Evaluate evaluates the expression with the current values of the topics, returned by value. It
+// fails if any topic has no value yet
+func (e *Expr) Evaluate(value func(topic string) (Value, bool)) (bool, error) {
+	switch {
+	case e.and != nil:
+		result := true
+		for _, child := range e.and {
+			ok, err := child.Evaluate(value)
+			if err != nil {
+				return false, err
+			}
+			result = result && ok
+		}
+		return result, nil
+	case e.or != nil:
+		result := false
+		for _, child := range e.or {
+			ok, err := child.Evaluate(value)
+			if err != nil {
+				return false, err
+			}
+			result = result || ok
+		}
+		return result, nil
+	case e.not != nil:
+		ok, err := e.not.Evaluate(value)
+		return !ok, err
+	}
+
+	v, ok := value(e.topic)
+	if !ok {
+		return false, fmt.Errorf("no value received yet for %s", e.topic)
+	}
+	if e.leaf.Numeric() {
+		return e.leaf.Triggered(v.Converted)
+	}
+	return e.leaf.Triggered(v.Raw)
+}
+
+// Topics returns the topics the expression depends on
+func (e *Expr) Topics() []string {
+	if e.topic != "" {
+		return []string{e.topic}
+	}
+	if e.not != nil {
+		return e.not.Topics()
+	}
+	var topics []string
+	for _, child := range e.and {
+		topics = append(topics, child.Topics()...)
+	}
+	for _, child := range e.or {
+		topics = append(topics, child.Topics()...)
+	}
+	return topics
+}
@@ -0,0 +1,79 @@
+package alarm
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/tommyblue/her/her"
+)
+
+func TestCompileExpr(t *testing.T) {
+	tests := []struct {
+		name string
+		conf her.ExprConf
+	}{
+		{"empty", her.ExprConf{}},
+		{"and and topic", her.ExprConf{And: []her.ExprConf{{Topic: "a", Operator: "equals"}}, Topic: "b"}},
+		{"invalid child", her.ExprConf{Or: []her.ExprConf{{Topic: "a", Operator: "bigger_than"}}}},
+		{"invalid not", her.ExprConf{Not: &her.ExprConf{}}},
+		{"rate operator", her.ExprConf{Topic: "a", Operator: "rises_by", Value: 1}},
+		{"other condition", her.ExprConf{Topic: her.ConditionKey("other"), Operator: "equals", Text: "true"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := CompileExpr(tt.conf); err == nil {
+				t.Error("Expected error")
+			}
+		})
+	}
+
+	if _, err := CompileCondition(her.ConditionConf{When: her.ExprConf{Topic: "a", Operator: "equals"}}); err == nil {
+		t.Error("Expected error for a condition without name")
+	}
+	if _, err := CompileCondition(her.ConditionConf{Name: "c", Severity: "fatal", When: her.ExprConf{Topic: "a", Operator: "equals"}}); err == nil {
+		t.Error("Expected error for an unknown severity")
+	}
+
+	_, err := CompileExpr(her.ExprConf{Topic: "a", Operator: "between", Min: 2, Max: 1})
+	if want := "topic a: alarm between: min 2 is greater than max 1"; err == nil || err.Error() != want {
+		t.Errorf("got error %v, want %q", err, want)
+	}
+}
+
+func TestEvaluateExpr(t *testing.T) {
+	window := her.ExprConf{Topic: "window", Operator: "equals", Text: "open"}
+	heating := her.ExprConf{Topic: "heating", Operator: "equals", Text: "ON"}
+	cold := her.ExprConf{Topic: "temperature", Operator: "less_than", Value: 19}
+	e, err := CompileExpr(her.ExprConf{And: []her.ExprConf{
+		window,
+		{Or: []her.ExprConf{heating, {Not: &cold}}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(e.Topics()); got != "[window heating temperature]" {
+		t.Errorf("unexpected topics %s", got)
+	}
+
+	tests := []struct {
+		values  map[string]string
+		want    bool
+		wantErr bool
+	}{
+		{map[string]string{"window": "open", "heating": "ON", "temperature": "18"}, true, false},
+		{map[string]string{"window": "open", "heating": "OFF", "temperature": "20"}, true, false},
+		{map[string]string{"window": "open", "heating": "OFF", "temperature": "18"}, false, false},
+		{map[string]string{"window": "closed", "heating": "ON", "temperature": "18"}, false, false},
+		{map[string]string{"window": "open", "heating": "ON"}, false, true},
+		{map[string]string{"window": "open", "heating": "ON", "temperature": "cold"}, false, true},
+	}
+	for _, tt := range tests {
+		got, err := e.Evaluate(func(topic string) (Value, bool) {
+			v, ok := tt.values[topic]
+			return Value{Raw: v, Converted: v}, ok
+		})
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("Evaluate(%v) = %v, %v, want %v", tt.values, got, err, tt.want)
+		}
+	}
+}
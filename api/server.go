@@ -4,13 +4,18 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/mux"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 	"github.com/tommyblue/her/her"
+	"github.com/tommyblue/her/state"
 )
 
+// resultTimeout is how long to wait for the outcome of an intent
+const resultTimeout = 15 * time.Second
+
 type Intent struct {
 	Action string `json:"action"`
 	Room   string `json:"room"`
@@ -18,19 +23,21 @@ type Intent struct {
 
 type Server struct {
 	outCh       chan<- her.Message
+	store       *state.Store
 	router      *mux.Router
 	intentConfs []her.IntentConf
 	host        string
 	port        int
 }
 
-func NewServer(host string, port int, outCh chan her.Message) (*Server, error) {
+func NewServer(host string, port int, outCh chan her.Message, store *state.Store) (*Server, error) {
 	if port == 0 {
 		port = 8080
 	}
 
 	s := &Server{
 		outCh: outCh,
+		store: store,
 		host:  host,
 		port:  port,
 	}
@@ -38,6 +45,11 @@ func NewServer(host string, port int, outCh chan her.Message) (*Server, error) {
 	if err := viper.UnmarshalKey("intents", &s.intentConfs); err != nil {
 		return nil, err
 	}
+	for _, i := range s.intentConfs {
+		if !her.ValidQoS(i.QoS) {
+			return nil, fmt.Errorf("intent %s/%s has an invalid qos %d", i.Action, i.Room, *i.QoS)
+		}
+	}
 
 	return s, nil
 }
@@ -46,6 +58,7 @@ func (s *Server) Start() {
 	s.router = mux.NewRouter() //.StrictSlash(true)
 	s.router.HandleFunc("/", s.homeLink)
 	s.router.HandleFunc("/alexa/", s.alexaLink) //.Methods("POST")
+	s.router.HandleFunc("/status", s.statusLink).Methods("GET")
 	go func() {
 		address := fmt.Sprintf("%s:%d", s.host, s.port)
 		log.Info("Listening on ", address)
@@ -65,22 +78,47 @@ func (s *Server) alexaLink(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	s.applyIntent(i)
+	switch s.applyIntent(i) {
+	case her.Published:
+		fmt.Fprintf(w, "ok")
+	case her.Queued:
+		fmt.Fprintf(w, "queued")
+	default:
+		fmt.Fprintf(w, "failed")
+	}
+}
 
-	fmt.Fprintf(w, "ok")
+func (s *Server) statusLink(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.store.Snapshot()); err != nil {
+		log.Error(err)
+	}
 }
 
 func (s *Server) homeLink(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "Welcome home!")
 }
 
-func (s *Server) applyIntent(i Intent) {
+func (s *Server) applyIntent(i Intent) her.PublishStatus {
 	for _, intentConf := range s.intentConfs {
 		if intentConf.Action == i.Action && intentConf.Room == i.Room {
 			log.Info(fmt.Sprintf("Applying Action: %s, Room: %s", i.Action, i.Room))
-			s.outCh <- her.Message{Topic: intentConf.Topic, Message: []byte(intentConf.Message)}
-			return
+			result := make(chan her.PublishResult, 1)
+			s.outCh <- her.Message{
+				Topic:   intentConf.Topic,
+				Message: []byte(intentConf.Message),
+				QoS:     intentConf.QoS,
+				Retain:  intentConf.Retain,
+				Result:  result,
+			}
+			select {
+			case r := <-result:
+				return r.Status
+			case <-time.After(resultTimeout):
+				return her.Failed
+			}
 		}
 	}
 	log.Warning(fmt.Sprintf("Cannot find Action: %s, Room: %s", i.Action, i.Room))
+	return her.Failed
 }
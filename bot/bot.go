@@ -3,19 +3,27 @@ package bot
 import (
 	"bytes"
 	"fmt"
+	"hash/fnv"
 	"os"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 	"github.com/tommyblue/her/her"
+	"github.com/tommyblue/her/state"
 )
 
 type BotImpl interface {
 	Connect() error
 	Stop() error
 	SendMessage(string) error
+	SendMessageTo(int64, string) error
+	SendAlarm(chatID int64, alarmID, message string) error
 	AddCommand(her.CommandConf) error
+	RemoveCommand(string) error
 }
 
 type Bot struct {
@@ -24,14 +32,16 @@ type Bot struct {
 	shutdownCh chan os.Signal
 	inCh       <-chan her.Message
 	outCh      chan<- her.Message
+	store      *state.Store
 }
 
-func NewBot(stopWg *sync.WaitGroup, shutdownCh chan os.Signal, outCh, inCh chan her.Message) (*Bot, error) {
+func NewBot(stopWg *sync.WaitGroup, shutdownCh chan os.Signal, outCh, inCh chan her.Message, store *state.Store) (*Bot, error) {
 	bot := &Bot{
 		stopWg:     stopWg,
 		shutdownCh: shutdownCh,
 		inCh:       inCh,
 		outCh:      outCh,
+		store:      store,
 	}
 
 	switch viper.GetString("bot.type") {
@@ -52,6 +62,10 @@ func (b *Bot) AddCommand(c her.CommandConf) error {
 	return b.bot.AddCommand(c)
 }
 
+func (b *Bot) RemoveCommand(command string) error {
+	return b.bot.RemoveCommand(command)
+}
+
 func (b *Bot) Connect() error {
 	if err := b.bot.Connect(); err != nil {
 		log.Error("Returning ", err)
@@ -64,9 +78,18 @@ func (b *Bot) Connect() error {
 			if message.Topic == "" || bytes.Equal(message.Message, []byte("")) {
 				continue
 			}
-			msg := fmt.Sprintf("[%s] %s", message.Topic, message.Message)
+			msg := message.Text
+			if msg == "" {
+				msg = fmt.Sprintf("[%s] %s", message.Topic, message.Message)
+			}
 			log.Info("Sending BOT message: ", msg)
-			if err := b.bot.SendMessage(msg); err != nil {
+			send := b.bot.SendMessage
+			if message.AlarmID != "" {
+				send = func(msg string) error { return b.bot.SendAlarm(message.ChatID, message.AlarmID, msg) }
+			} else if message.ChatID != 0 {
+				send = func(msg string) error { return b.bot.SendMessageTo(message.ChatID, msg) }
+			}
+			if err := send(msg); err != nil {
 				log.Error(err)
 			}
 		case <-b.shutdownCh:
@@ -79,3 +102,166 @@ func (b *Bot) Connect() error {
 		}
 	}
 }
+
+// statusMessage returns the last known value of each subscription
+func (b *Bot) statusMessage() string {
+	entries := b.store.Snapshot()
+	if len(entries) == 0 {
+		return "No values received yet"
+	}
+
+	var sb strings.Builder
+	for _, e := range entries {
+		if e.StatusLine != "" {
+			sb.WriteString(e.StatusLine)
+		} else {
+			sb.WriteString(fmt.Sprintf("%s: %s", e.Label, e.Value))
+			if e.Unit != "" {
+				sb.WriteString(" " + e.Unit)
+			}
+			if severity := e.Severity(); severity != "" {
+				sb.WriteString(fmt.Sprintf(" (%s)", severity))
+			}
+		}
+		if e.Stale() {
+			sb.WriteString(fmt.Sprintf(" (stale since %s)", e.StaleSince.Format("2006-01-02 15:04")))
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+// activeAlarm is an active alarm of a subscription
+type activeAlarm struct {
+	entry state.Entry
+	name  string
+	alarm state.Alarm
+}
+
+// activeAlarms returns the active alarms, sorted by key and name
+func (b *Bot) activeAlarms() []activeAlarm {
+	var alarms []activeAlarm
+	for _, e := range b.store.Snapshot() {
+		names := make([]string, 0, len(e.Alarms))
+		for name, a := range e.Alarms {
+			if a.Active {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			alarms = append(alarms, activeAlarm{entry: e, name: name, alarm: e.Alarms[name]})
+		}
+	}
+	return alarms
+}
+
+// alarmsMessage lists the active alarms and who acknowledged them
+func (b *Bot) alarmsMessage() string {
+	alarms := b.activeAlarms()
+	if len(alarms) == 0 {
+		return "No active alarms"
+	}
+
+	var sb strings.Builder
+	for _, a := range alarms {
+		sb.WriteString(fmt.Sprintf("[%s] %s %s: %s", a.alarm.Severity, a.entry.Label, a.name, a.alarm.Value))
+		if a.entry.Unit != "" {
+			sb.WriteString(" " + a.entry.Unit)
+		}
+		if !a.alarm.TriggeredAt.IsZero() {
+			sb.WriteString(fmt.Sprintf(" since %s", a.alarm.TriggeredAt.Format("2006-01-02 15:04")))
+		}
+		if a.alarm.Acked() {
+			sb.WriteString(fmt.Sprintf(", acknowledged by %s at %s", a.alarm.AckedBy, a.alarm.AckedAt.Format("2006-01-02 15:04")))
+		} else {
+			sb.WriteString(", not acknowledged")
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+// ackAlarms acknowledges the active alarms matching the target, either the alarm name or its id
+// (key#name). Without a target every active alarm is acknowledged
+func (b *Bot) ackAlarms(target, by string) string {
+	target = strings.TrimSpace(target)
+	var acked []string
+	for _, a := range b.activeAlarms() {
+		if target != "" && target != a.name && target != her.AlarmID(a.entry.Key, a.name) {
+			continue
+		}
+		if b.store.Ack(a.entry.Key, a.name, by, time.Now()) {
+			acked = append(acked, fmt.Sprintf("%s %s", a.entry.Label, a.name))
+		}
+	}
+	if len(acked) == 0 {
+		return "No alarm to acknowledge"
+	}
+	return fmt.Sprintf("Acknowledged by %s: %s", by, strings.Join(acked, ", "))
+}
+
+// ackCallbackData returns the data of the button acknowledging the alarm. Telegram limits it to
+// 64 bytes, so the alarm id is hashed
+func ackCallbackData(alarmID string) string {
+	h := fnv.New64a()
+	h.Write([]byte(alarmID))
+	return fmt.Sprintf("ack:%x", h.Sum64())
+}
+
+// ackCallback acknowledges the alarm whose button has been tapped
+func (b *Bot) ackCallback(data, by string) string {
+	for _, a := range b.activeAlarms() {
+		id := her.AlarmID(a.entry.Key, a.name)
+		if ackCallbackData(id) == data {
+			return b.ackAlarms(id, by)
+		}
+	}
+	return "No alarm to acknowledge"
+}
+
+// mute silences a subscription, or all of them, the arguments being the target and the duration
+func (b *Bot) mute(args, by string) string {
+	fields := strings.Fields(args)
+	if len(fields) < 2 {
+		return "Usage: /mute <subscription|all> <duration>, e.g. /mute all 2h"
+	}
+	d, err := time.ParseDuration(fields[len(fields)-1])
+	if err != nil || d <= 0 {
+		return fmt.Sprintf("Invalid duration %s", fields[len(fields)-1])
+	}
+	target := strings.Join(fields[:len(fields)-1], " ")
+	until := time.Now().Add(d)
+	b.store.Mute(state.Mute{Target: target, Until: until, By: by})
+	return fmt.Sprintf("Muted %s until %s", target, until.Format("2006-01-02 15:04"))
+}
+
+// unmute removes the mute of the target, or all of them without a target
+func (b *Bot) unmute(target string) string {
+	target = strings.TrimSpace(target)
+	if !b.store.Unmute(target) {
+		return "Nothing to unmute"
+	}
+	if target == "" {
+		return "Unmuted everything"
+	}
+	return fmt.Sprintf("Unmuted %s", target)
+}
+
+// mutesMessage lists the active mutes
+func (b *Bot) mutesMessage() string {
+	mutes := b.store.Mutes(time.Now())
+	if len(mutes) == 0 {
+		return "Nothing is muted"
+	}
+
+	var sb strings.Builder
+	for _, m := range mutes {
+		sb.WriteString(fmt.Sprintf("%s until %s", m.Target, m.Until.Format("2006-01-02 15:04")))
+		if m.By != "" {
+			sb.WriteString(fmt.Sprintf(", by %s", m.By))
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
@@ -3,12 +3,16 @@ package bot
 import (
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	viper "github.com/spf13/viper"
 
 	"github.com/tommyblue/her/her"
+	"github.com/tommyblue/her/state"
 )
 
 type MockBot struct {
@@ -16,6 +20,8 @@ type MockBot struct {
 	connectRetErr    bool
 	stopRetErr       bool
 	receivedMsg      string
+	receivedChatID   int64
+	receivedAlarmID  string
 	receiveWg        *sync.WaitGroup
 	calledReceive    bool
 	receiveReturnErr bool
@@ -42,10 +48,22 @@ func (b *MockBot) SendMessage(msg string) error {
 	}
 	return nil
 }
+func (b *MockBot) SendMessageTo(chatID int64, msg string) error {
+	b.receivedChatID = chatID
+	return b.SendMessage(msg)
+}
+func (b *MockBot) SendAlarm(chatID int64, alarmID, msg string) error {
+	b.receivedAlarmID = alarmID
+	return b.SendMessageTo(chatID, msg)
+}
 func (b *MockBot) AddCommand(c her.CommandConf) error {
 	b.commands++
 	return nil
 }
+func (b *MockBot) RemoveCommand(command string) error {
+	b.commands--
+	return nil
+}
 
 func TestNewBot(t *testing.T) {
 	var stopWg sync.WaitGroup
@@ -54,7 +72,7 @@ func TestNewBot(t *testing.T) {
 	inCh := make(chan her.Message)
 
 	t.Run("Without config value", func(t *testing.T) {
-		_, err := NewBot(&stopWg, shutdownCh, outCh, inCh)
+		_, err := NewBot(&stopWg, shutdownCh, outCh, inCh, state.NewStore())
 		if err == nil {
 			t.Errorf("Expected error")
 		}
@@ -62,7 +80,7 @@ func TestNewBot(t *testing.T) {
 
 	t.Run("Without unkown config value", func(t *testing.T) {
 		viper.Set("bot.type", "unknown")
-		_, err := NewBot(&stopWg, shutdownCh, outCh, inCh)
+		_, err := NewBot(&stopWg, shutdownCh, outCh, inCh, state.NewStore())
 		if err == nil {
 			t.Errorf("Expected error")
 		}
@@ -71,7 +89,7 @@ func TestNewBot(t *testing.T) {
 	t.Run("With correct config value but missing bot.token", func(t *testing.T) {
 		viper.Set("bot.type", "telegram")
 		viper.Set("bot.channel_id", 1)
-		_, err := NewBot(&stopWg, shutdownCh, outCh, inCh)
+		_, err := NewBot(&stopWg, shutdownCh, outCh, inCh, state.NewStore())
 		if err == nil {
 			t.Errorf("Expected error")
 		}
@@ -81,7 +99,7 @@ func TestNewBot(t *testing.T) {
 		viper.Set("bot.type", "telegram")
 		viper.Set("bot.token", "token")
 		viper.Set("bot.channel_id", 0)
-		_, err := NewBot(&stopWg, shutdownCh, outCh, inCh)
+		_, err := NewBot(&stopWg, shutdownCh, outCh, inCh, state.NewStore())
 		if err == nil {
 			t.Errorf("Expected error")
 		}
@@ -91,7 +109,7 @@ func TestNewBot(t *testing.T) {
 		viper.Set("bot.type", "telegram")
 		viper.Set("bot.channel_id", 1)
 		viper.Set("bot.token", "token")
-		_, err := NewBot(&stopWg, shutdownCh, outCh, inCh)
+		_, err := NewBot(&stopWg, shutdownCh, outCh, inCh, state.NewStore())
 		if err != nil {
 			t.Errorf("Unexpected error")
 		}
@@ -107,6 +125,26 @@ func TestAddCommand(t *testing.T) {
 	if b.bot.(*MockBot).commands != 1 {
 		t.Errorf("Command not added")
 	}
+	_ = b.RemoveCommand(c.Command)
+	if b.bot.(*MockBot).commands != 0 {
+		t.Errorf("Command not removed")
+	}
+}
+
+func TestTelegramCommands(t *testing.T) {
+	tb := &TelegramBot{commands: make(map[string]her.CommandConf)}
+	if err := tb.AddCommand(her.CommandConf{Command: "on", Help: "Switch on"}); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if err := tb.AddCommand(her.CommandConf{Command: "on"}); err == nil {
+		t.Errorf("Expected error adding a duplicated command")
+	}
+	if err := tb.RemoveCommand("on"); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if err := tb.RemoveCommand("on"); err == nil {
+		t.Errorf("Expected error removing a missing command")
+	}
 }
 
 func TestConnect(t *testing.T) {
@@ -184,6 +222,42 @@ func TestConnect(t *testing.T) {
 			t.Errorf("Unexpected error")
 		}
 	})
+	t.Run("Send message to chat", func(t *testing.T) {
+		inCh := make(chan her.Message)
+		shutdownCh := make(chan os.Signal, 1)
+		var stopWg sync.WaitGroup
+		stopWg.Add(1)
+		var receiveWg sync.WaitGroup
+		mock := &MockBot{receiveWg: &receiveWg}
+		b := &Bot{
+			inCh:       inCh,
+			shutdownCh: shutdownCh,
+			stopWg:     &stopWg,
+			bot:        mock,
+		}
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			b.Connect()
+			wg.Done()
+		}()
+
+		receiveWg.Add(1)
+		inCh <- her.Message{Topic: "topic", Message: []byte("Alarm"), Text: "Alarm", ChatID: 42}
+		receiveWg.Wait()
+		if mock.receivedMsg != "Alarm" || mock.receivedChatID != 42 {
+			t.Errorf("got %q to chat %d", mock.receivedMsg, mock.receivedChatID)
+		}
+
+		receiveWg.Add(1)
+		inCh <- her.Message{Topic: "topic", Message: []byte("Leak"), Text: "Leak", AlarmID: "topic#leak"}
+		receiveWg.Wait()
+		if mock.receivedMsg != "Leak" || mock.receivedAlarmID != "topic#leak" {
+			t.Errorf("got %q for alarm %q", mock.receivedMsg, mock.receivedAlarmID)
+		}
+		b.shutdownCh <- os.Interrupt
+		wg.Wait()
+	})
 	t.Run("Send empty message", func(t *testing.T) {
 		inCh := make(chan her.Message)
 		shutdownCh := make(chan os.Signal, 1)
@@ -278,3 +352,187 @@ func TestConnect(t *testing.T) {
 		}
 	})
 }
+
+func TestStatusMessage(t *testing.T) {
+	b := &Bot{store: state.NewStore()}
+	if got := b.statusMessage(); got != "No values received yet" {
+		t.Errorf("unexpected status %q", got)
+	}
+
+	b.store.Update("sensor/kitchen", "sensor/kitchen", "Kitchen", "21.5", "", time.Now())
+	b.store.Update("sensor/bedroom", "sensor/bedroom", "Bedroom", "19", "", time.Now())
+	want := "Bedroom: 19\nKitchen: 21.5\n"
+	if got := b.statusMessage(); got != want {
+		t.Errorf("want: %q, got: %q", want, got)
+	}
+
+	// Values loaded from the saved state are stale until updated
+	path := filepath.Join(t.TempDir(), "state.json")
+	if err := b.store.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	b.store = state.NewStore()
+	if err := b.store.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	b.store.Update("sensor/bedroom", "sensor/bedroom", "Bedroom", "20", "", time.Now())
+	e, _ := b.store.Get("sensor/kitchen")
+	want = fmt.Sprintf("Bedroom: 20\nKitchen: 21.5 (stale since %s)\n", e.StaleSince.Format("2006-01-02 15:04"))
+	if got := b.statusMessage(); got != want {
+		t.Errorf("want: %q, got: %q", want, got)
+	}
+
+	// Lines formatted by the status templates are used as they are
+	b.store.SetStatusLine("sensor/bedroom", "Bedroom is 20 °C")
+	want = fmt.Sprintf("Bedroom is 20 °C\nKitchen: 21.5 (stale since %s)\n", e.StaleSince.Format("2006-01-02 15:04"))
+	if got := b.statusMessage(); got != want {
+		t.Errorf("want: %q, got: %q", want, got)
+	}
+}
+
+func TestAlarms(t *testing.T) {
+	b := &Bot{store: state.NewStore()}
+	if got := b.alarmsMessage(); got != "No active alarms" {
+		t.Errorf("unexpected alarms %q", got)
+	}
+
+	triggeredAt := time.Date(2023, 1, 1, 10, 0, 0, 0, time.UTC)
+	b.store.Update("bathroom/leak", "bathroom/leak", "Bathroom", "wet", "", triggeredAt)
+	b.store.Update("sensor/kitchen", "sensor/kitchen", "Kitchen", "31", "°C", triggeredAt)
+	b.store.SetAlarm("bathroom/leak", "leak", state.Alarm{Active: true, Severity: "critical", Value: "wet", TriggeredAt: triggeredAt})
+	b.store.SetAlarm("sensor/kitchen", "hot", state.Alarm{Active: true, Severity: "warning", Value: "31", TriggeredAt: triggeredAt})
+	b.store.SetAlarm("sensor/kitchen", "cold", state.Alarm{Severity: "warning"})
+	want := "[critical] Bathroom leak: wet since 2023-01-01 10:00, not acknowledged\n" +
+		"[warning] Kitchen hot: 31 °C since 2023-01-01 10:00, not acknowledged\n"
+	if got := b.alarmsMessage(); got != want {
+		t.Errorf("want: %q, got: %q", want, got)
+	}
+
+	tests := []struct {
+		name   string
+		target string
+		want   string
+	}{
+		{"Inactive alarm", "cold", "No alarm to acknowledge"},
+		{"By name", "hot", "Acknowledged by tommy: Kitchen hot"},
+		{"Already acknowledged", "sensor/kitchen#hot", "No alarm to acknowledge"},
+		{"All", "", "Acknowledged by tommy: Bathroom leak"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := b.ackAlarms(tt.target, "tommy"); got != tt.want {
+				t.Errorf("want: %q, got: %q", tt.want, got)
+			}
+		})
+	}
+	e, _ := b.store.Get("sensor/kitchen")
+	if got := b.alarmsMessage(); !strings.Contains(got, "Kitchen hot: 31 °C since 2023-01-01 10:00, acknowledged by tommy at "+e.Alarms["hot"].AckedAt.Format("2006-01-02 15:04")) {
+		t.Errorf("unexpected alarms %q", got)
+	}
+
+	// The inline button carries a hash of the alarm id
+	b.store.SetAlarm("bathroom/leak", "leak", state.Alarm{Active: true, Severity: "critical", Value: "wet"})
+	if got := b.ackCallback(ackCallbackData("sensor/kitchen#missing"), "tommy"); got != "No alarm to acknowledge" {
+		t.Errorf("unexpected reply %q", got)
+	}
+	if got := b.ackCallback(ackCallbackData("bathroom/leak#leak"), "tommy"); got != "Acknowledged by tommy: Bathroom leak" {
+		t.Errorf("unexpected reply %q", got)
+	}
+}
+
+func TestMute(t *testing.T) {
+	b := &Bot{store: state.NewStore()}
+	if got := b.mutesMessage(); got != "Nothing is muted" {
+		t.Errorf("unexpected mutes %q", got)
+	}
+
+	tests := []struct {
+		args string
+		want string
+	}{
+		{"", "Usage: /mute <subscription|all> <duration>, e.g. /mute all 2h"},
+		{"all", "Usage: /mute <subscription|all> <duration>, e.g. /mute all 2h"},
+		{"all forever", "Invalid duration forever"},
+		{"all -1h", "Invalid duration -1h"},
+	}
+	for _, tt := range tests {
+		if got := b.mute(tt.args, "tommy"); got != tt.want {
+			t.Errorf("mute(%q) = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+
+	if got := b.mute("Kitchen temperature 2h", "tommy"); !strings.HasPrefix(got, "Muted Kitchen temperature until ") {
+		t.Errorf("unexpected reply %q", got)
+	}
+	if !b.store.Muted(time.Now().Add(time.Hour), "kitchen temperature") {
+		t.Error("Subscription not muted")
+	}
+	mutes := b.store.Mutes(time.Now())
+	want := fmt.Sprintf("Kitchen temperature until %s, by tommy\n", mutes[0].Until.Format("2006-01-02 15:04"))
+	if got := b.mutesMessage(); got != want {
+		t.Errorf("want: %q, got: %q", want, got)
+	}
+
+	if got := b.unmute("Bedroom"); got != "Nothing to unmute" {
+		t.Errorf("unexpected reply %q", got)
+	}
+	if got := b.unmute(" kitchen temperature "); got != "Unmuted kitchen temperature" {
+		t.Errorf("unexpected reply %q", got)
+	}
+	b.mute("all 1h", "tommy")
+	if got := b.unmute(""); got != "Unmuted everything" {
+		t.Errorf("unexpected reply %q", got)
+	}
+}
+
+func TestCheckCommands(t *testing.T) {
+	outCh := make(chan her.Message)
+	tb := &TelegramBot{
+		bot:      &Bot{outCh: outCh},
+		commands: map[string]her.CommandConf{"on": {Command: "on", Topic: "light", Message: "ON", FeedbackMsg: "Switched on"}},
+	}
+
+	tests := []struct {
+		result her.PublishResult
+		want   string
+	}{
+		{her.PublishResult{Status: her.Published}, "Switched on"},
+		{her.PublishResult{Status: her.Queued}, "The broker is unreachable, /on will be sent when it's back"},
+		{her.PublishResult{Status: her.Failed, Err: fmt.Errorf("error")}, "Cannot send /on: error"},
+	}
+	for _, tt := range tests {
+		go func(result her.PublishResult) {
+			msg := <-outCh
+			msg.Result <- result
+		}(tt.result)
+		if got := tb.checkCommands("on", ""); got != tt.want {
+			t.Errorf("want: %q, got: %q", tt.want, got)
+		}
+	}
+
+	tb.commands["light"] = her.CommandConf{Command: "light", Label: "kitchen light", Topic: "cmnd/light", Message: "ON", StateTopic: "stat/light"}
+	confirmTests := []struct {
+		result her.PublishResult
+		want   string
+	}{
+		{her.PublishResult{Status: her.Published, Confirmed: true}, "✅ kitchen light is ON"},
+		{her.PublishResult{Status: her.Published}, "⚠️ no confirmation after 5s"},
+		{her.PublishResult{Status: her.Queued}, "The broker is unreachable, /light will be sent when it's back"},
+	}
+	for _, tt := range confirmTests {
+		go func(result her.PublishResult) {
+			msg := <-outCh
+			if msg.Confirm == nil || msg.Confirm.Topic != "stat/light" || msg.Confirm.Payload != "ON" {
+				t.Errorf("unexpected confirmation %+v", msg.Confirm)
+			}
+			msg.Result <- result
+		}(tt.result)
+		if got := tb.checkCommands("light", ""); got != tt.want {
+			t.Errorf("want: %q, got: %q", tt.want, got)
+		}
+	}
+
+	if got := tb.checkCommands("off", ""); got != "I don't know that command" {
+		t.Errorf("unexpected reply %q", got)
+	}
+}
@@ -3,7 +3,10 @@ package bot
 import (
 	"errors"
 	"fmt"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
 	log "github.com/sirupsen/logrus"
@@ -11,11 +14,16 @@ import (
 	"github.com/tommyblue/her/her"
 )
 
+// resultTimeout is how long to wait for the outcome of a command. The MQTT client replies as soon as
+// the message is published or queued, or when the device confirms it if a state topic is configured
+const resultTimeout = 15 * time.Second
+
 type TelegramBot struct {
 	api       *tgbotapi.BotAPI
 	token     string
 	channelId int64
 	bot       *Bot
+	mu        sync.RWMutex
 	commands  map[string]her.CommandConf
 }
 
@@ -75,12 +83,32 @@ func (t *TelegramBot) Stop() error {
 }
 
 func (t *TelegramBot) SendMessage(message string) error {
-	msg := tgbotapi.NewMessage(t.channelId, message)
+	return t.SendMessageTo(t.channelId, message)
+}
+
+func (t *TelegramBot) SendMessageTo(chatID int64, message string) error {
+	msg := tgbotapi.NewMessage(chatID, message)
+	_, err := t.api.Send(msg)
+	return err
+}
+
+// SendAlarm sends an alarm with a button to acknowledge it. Without a chat the alarm goes to the channel
+func (t *TelegramBot) SendAlarm(chatID int64, alarmID, message string) error {
+	if chatID == 0 {
+		chatID = t.channelId
+	}
+	msg := tgbotapi.NewMessage(chatID, message)
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("Acknowledge", ackCallbackData(alarmID)),
+	))
 	_, err := t.api.Send(msg)
 	return err
 }
 
 func (t *TelegramBot) AddCommand(c her.CommandConf) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
 	_, ok := t.commands[c.Command]
 	if ok {
 		return fmt.Errorf("command %s already exists", c.Command)
@@ -90,7 +118,23 @@ func (t *TelegramBot) AddCommand(c her.CommandConf) error {
 	return nil
 }
 
+func (t *TelegramBot) RemoveCommand(command string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.commands[command]; !ok {
+		return fmt.Errorf("command %s doesn't exist", command)
+	}
+	delete(t.commands, command)
+
+	return nil
+}
+
 func (t *TelegramBot) messageReceived(update tgbotapi.Update) {
+	if update.CallbackQuery != nil {
+		t.callbackReceived(update.CallbackQuery)
+		return
+	}
 	if update.Message == nil {
 		return
 	}
@@ -103,13 +147,48 @@ func (t *TelegramBot) messageReceived(update tgbotapi.Update) {
 		case "help":
 			msg.Text = t.printHelp()
 		case "status", "s":
-			t.bot.outCh <- her.Message{Command: "status"}
+			msg.Text = t.bot.statusMessage()
+		case "alarms":
+			msg.Text = t.bot.alarmsMessage()
+		case "ack":
+			msg.Text = t.bot.ackAlarms(update.Message.CommandArguments(), update.Message.From.String())
+		case "mute":
+			msg.Text = t.bot.mute(update.Message.CommandArguments(), update.Message.From.String())
+		case "unmute":
+			msg.Text = t.bot.unmute(update.Message.CommandArguments())
+		case "mutes":
+			msg.Text = t.bot.mutesMessage()
 		default:
-			msg.Text = t.checkCommands(update.Message.Command(), update.Message.CommandArguments())
-		}
-		if _, err := t.api.Send(msg); err != nil {
-			log.Error(err)
+			// Commands can wait for the device confirmation, so reply without holding back the updates
+			go func(command, args string) {
+				msg.Text = t.checkCommands(command, args)
+				t.send(msg)
+			}(update.Message.Command(), update.Message.CommandArguments())
+			return
 		}
+		t.send(msg)
+	}
+}
+
+// callbackReceived handles the inline buttons, acknowledging the alarms
+func (t *TelegramBot) callbackReceived(query *tgbotapi.CallbackQuery) {
+	log.Info(fmt.Sprintf("[%s] callback %s", query.From.String(), query.Data))
+
+	text := "Unknown action"
+	if strings.HasPrefix(query.Data, "ack:") {
+		text = t.bot.ackCallback(query.Data, query.From.String())
+	}
+	if _, err := t.api.AnswerCallbackQuery(tgbotapi.NewCallback(query.ID, text)); err != nil {
+		log.Error(err)
+	}
+	if query.Message != nil {
+		t.send(tgbotapi.NewMessage(query.Message.Chat.ID, text))
+	}
+}
+
+func (t *TelegramBot) send(msg tgbotapi.MessageConfig) {
+	if _, err := t.api.Send(msg); err != nil {
+		log.Error(err)
 	}
 }
 
@@ -119,18 +198,57 @@ func (t *TelegramBot) printHelp() string {
 	b.WriteString("/help - Get this help\n")
 	b.WriteString("/status - Return subscriptions last known status\n")
 	b.WriteString("/s - Alias for /status\n")
-	for command, conf := range t.commands {
-		b.WriteString(fmt.Sprintf("/%s - %s\n", command, conf.Help))
+	b.WriteString("/alarms - List the active alarms\n")
+	b.WriteString("/ack [alarm] - Acknowledge an alarm, or all of them\n")
+	b.WriteString("/mute <subscription|all> <duration> - Silence notifications and alarms\n")
+	b.WriteString("/unmute [subscription|all] - Remove a mute, or all of them\n")
+	b.WriteString("/mutes - List the active mutes\n")
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	commands := make([]string, 0, len(t.commands))
+	for command := range t.commands {
+		commands = append(commands, command)
+	}
+	sort.Strings(commands)
+	for _, command := range commands {
+		b.WriteString(fmt.Sprintf("/%s - %s\n", command, t.commands[command].Help))
 	}
 	return b.String()
 }
 
 func (t *TelegramBot) checkCommands(command, args string) string {
+	t.mu.RLock()
 	cmd, ok := t.commands[command]
+	t.mu.RUnlock()
 	if !ok {
 		log.Error("Unknown command: ", command)
 		return "I don't know that command"
 	}
-	t.bot.outCh <- her.Message{Topic: cmd.Topic, Message: []byte(cmd.Message)}
+	confirmation := cmd.Confirmation()
+	timeout := resultTimeout
+	if confirmation != nil {
+		timeout += confirmation.Timeout
+	}
+	result := make(chan her.PublishResult, 1)
+	t.bot.outCh <- her.Message{Topic: cmd.Topic, Message: []byte(cmd.Message), QoS: cmd.QoS, Retain: cmd.Retain, Result: result, Confirm: confirmation}
+
+	select {
+	case r := <-result:
+		switch r.Status {
+		case her.Queued:
+			return fmt.Sprintf("The broker is unreachable, /%s will be sent when it's back", command)
+		case her.Failed:
+			return fmt.Sprintf("Cannot send /%s: %v", command, r.Err)
+		}
+		if confirmation != nil {
+			if !r.Confirmed {
+				return fmt.Sprintf("⚠️ no confirmation after %s", confirmation.Timeout)
+			}
+			return fmt.Sprintf("✅ %s is %s", cmd.DeviceLabel(), confirmation.Payload)
+		}
+	case <-time.After(timeout):
+		return fmt.Sprintf("No answer from the broker for /%s", command)
+	}
 	return cmd.FeedbackMsg
 }
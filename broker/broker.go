@@ -0,0 +1,406 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	log "github.com/sirupsen/logrus"
+	"github.com/tommyblue/her/her"
+)
+
+const (
+	// connectTimeout is how long a new connection can wait before sending CONNECT
+	connectTimeout = 10 * time.Second
+	// writeTimeout protects the publishers from subscribers not reading their connection
+	writeTimeout = 10 * time.Second
+)
+
+// Broker is a minimal MQTT 3.1.1 broker, meant for small standalone installs and tests. It supports
+// QoS 0 and 1 (QoS 2 publications are accepted once and delivered with QoS 1), retained messages,
+// wildcards, last wills and username/password authentication. Sessions are always clean, so QoS 1
+// messages are sent once and not retried if the subscriber disconnects before acknowledging them
+type Broker struct {
+	addr     string
+	users    map[string]string
+	listener net.Listener
+	mu       sync.Mutex
+	clients  map[string]*client
+	retained map[string]*packets.PublishPacket
+	closed   bool
+}
+
+// New returns a broker listening on addr. If users is not empty, clients must authenticate with
+// one of its usernames and the related password
+func New(addr string, users map[string]string) *Broker {
+	return &Broker{
+		addr:     addr,
+		users:    users,
+		clients:  make(map[string]*client),
+		retained: make(map[string]*packets.PublishPacket),
+	}
+}
+
+func (b *Broker) Start() error {
+	l, err := net.Listen("tcp", b.addr)
+	if err != nil {
+		return fmt.Errorf("cannot start the MQTT broker: %w", err)
+	}
+	b.listener = l
+	log.Info("MQTT broker listening on ", l.Addr())
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				log.Error(err)
+				continue
+			}
+			go b.serve(conn)
+		}
+	}()
+	return nil
+}
+
+// Addr returns the address the broker is listening on
+func (b *Broker) Addr() net.Addr {
+	return b.listener.Addr()
+}
+
+// Close stops accepting connections and disconnects all the clients
+func (b *Broker) Close() error {
+	b.mu.Lock()
+	b.closed = true
+	for _, c := range b.clients {
+		c.conn.Close()
+	}
+	b.mu.Unlock()
+
+	return b.listener.Close()
+}
+
+type client struct {
+	id      string
+	conn    net.Conn
+	writeMu sync.Mutex
+	subs    map[string]byte // Topic filters with their granted QoS
+	will    *packets.PublishPacket
+	nextID  uint16
+	// QoS 2 publications received and waiting for PUBREL, when they're delivered. Only used by
+	// the goroutine serving the client
+	received map[uint16]*packets.PublishPacket
+}
+
+func (c *client) write(p packets.ControlPacket) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if err := c.conn.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
+		return err
+	}
+	return p.Write(c.conn)
+}
+
+// messageID returns the id of the next QoS 1 message sent to the client. It must be called holding
+// the broker lock
+func (c *client) messageID() uint16 {
+	c.nextID++
+	if c.nextID == 0 {
+		c.nextID = 1
+	}
+	return c.nextID
+}
+
+func (b *Broker) serve(conn net.Conn) {
+	defer conn.Close()
+
+	c, keepAlive, err := b.connect(conn)
+	if err != nil {
+		log.Warning("MQTT broker: ", err)
+		return
+	}
+	log.Debug("MQTT broker: client connected ", c.id)
+
+	for {
+		if keepAlive > 0 {
+			// The client must send a packet within one and a half times the keep alive
+			if err := conn.SetReadDeadline(time.Now().Add(keepAlive * 3 / 2)); err != nil {
+				break
+			}
+		}
+		p, err := packets.ReadPacket(conn)
+		if err != nil {
+			break
+		}
+		if disconnect := b.handle(c, p); disconnect {
+			break
+		}
+	}
+
+	b.disconnect(c)
+}
+
+// connect handles the CONNECT packet, returning the registered client and its keep alive
+func (b *Broker) connect(conn net.Conn) (*client, time.Duration, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(connectTimeout)); err != nil {
+		return nil, 0, err
+	}
+	p, err := packets.ReadPacket(conn)
+	if err != nil {
+		return nil, 0, err
+	}
+	cp, ok := p.(*packets.ConnectPacket)
+	if !ok {
+		return nil, 0, fmt.Errorf("expected CONNECT from %s, got %s", conn.RemoteAddr(), p)
+	}
+
+	c := &client{
+		id:       cp.ClientIdentifier,
+		conn:     conn,
+		subs:     make(map[string]byte),
+		received: make(map[uint16]*packets.PublishPacket),
+	}
+
+	connack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+	connack.ReturnCode = cp.Validate()
+	if connack.ReturnCode == packets.Accepted {
+		connack.ReturnCode = b.authenticate(cp)
+	}
+	if err := c.write(connack); err != nil {
+		return nil, 0, err
+	}
+	if connack.ReturnCode != packets.Accepted {
+		return nil, 0, fmt.Errorf("connection refused to %s: %s", conn.RemoteAddr(), packets.ConnackReturnCodes[connack.ReturnCode])
+	}
+
+	if c.id == "" {
+		c.id = fmt.Sprintf("auto-%s", conn.RemoteAddr())
+	}
+	if cp.WillFlag {
+		will := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		will.TopicName = cp.WillTopic
+		will.Payload = cp.WillMessage
+		will.Qos = cp.WillQos
+		will.Retain = cp.WillRetain
+		c.will = will
+	}
+
+	b.mu.Lock()
+	// A client connecting with the id of a connected client takes its place
+	if old, ok := b.clients[c.id]; ok {
+		old.will = nil
+		old.conn.Close()
+	}
+	b.clients[c.id] = c
+	b.mu.Unlock()
+
+	return c, time.Duration(cp.Keepalive) * time.Second, nil
+}
+
+func (b *Broker) authenticate(cp *packets.ConnectPacket) byte {
+	if len(b.users) == 0 {
+		return packets.Accepted
+	}
+	if !cp.UsernameFlag || !cp.PasswordFlag {
+		return packets.ErrRefusedNotAuthorised
+	}
+	if password, ok := b.users[cp.Username]; !ok || password != string(cp.Password) {
+		return packets.ErrRefusedBadUsernameOrPassword
+	}
+	return packets.Accepted
+}
+
+// handle processes a packet sent by the client, returning true if the connection must be closed
+func (b *Broker) handle(c *client, p packets.ControlPacket) bool {
+	switch p := p.(type) {
+	case *packets.PublishPacket:
+		if strings.ContainsAny(p.TopicName, "+#") {
+			return true
+		}
+		switch p.Qos {
+		case 0:
+			b.publish(p)
+		case 1:
+			b.publish(p)
+			ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+			ack.MessageID = p.MessageID
+			return c.write(ack) != nil
+		case 2:
+			// Delivered on PUBREL, so that the retransmissions before it aren't delivered twice
+			if _, ok := c.received[p.MessageID]; !ok {
+				c.received[p.MessageID] = p
+			}
+			rec := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+			rec.MessageID = p.MessageID
+			return c.write(rec) != nil
+		}
+	case *packets.PubrelPacket:
+		if pub, ok := c.received[p.MessageID]; ok {
+			delete(c.received, p.MessageID)
+			b.publish(pub)
+		}
+		comp := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+		comp.MessageID = p.MessageID
+		return c.write(comp) != nil
+	case *packets.SubscribePacket:
+		return b.subscribe(c, p) != nil
+	case *packets.UnsubscribePacket:
+		b.mu.Lock()
+		for _, topic := range p.Topics {
+			delete(c.subs, topic)
+		}
+		b.mu.Unlock()
+		ack := packets.NewControlPacket(packets.Unsuback).(*packets.UnsubackPacket)
+		ack.MessageID = p.MessageID
+		return c.write(ack) != nil
+	case *packets.PingreqPacket:
+		return c.write(packets.NewControlPacket(packets.Pingresp)) != nil
+	case *packets.DisconnectPacket:
+		// A clean disconnection discards the last will
+		b.mu.Lock()
+		c.will = nil
+		b.mu.Unlock()
+		return true
+	case *packets.PubackPacket, *packets.PubrecPacket, *packets.PubcompPacket:
+		// Messages are sent once, so there's nothing to do with their acknowledgements
+	case *packets.ConnectPacket:
+		// A second CONNECT is a protocol violation
+		return true
+	}
+	return false
+}
+
+func (b *Broker) subscribe(c *client, p *packets.SubscribePacket) error {
+	ack := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+	ack.MessageID = p.MessageID
+
+	var retained []*packets.PublishPacket
+	b.mu.Lock()
+	for i, filter := range p.Topics {
+		if !validFilter(filter) {
+			ack.ReturnCodes = append(ack.ReturnCodes, 0x80)
+			continue
+		}
+		qos := p.Qoss[i]
+		if qos > 1 {
+			qos = 1
+		}
+		c.subs[filter] = qos
+		ack.ReturnCodes = append(ack.ReturnCodes, qos)
+
+		for topic, r := range b.retained {
+			if her.TopicMatches(filter, topic) {
+				retained = append(retained, b.delivery(c, r, qos, true))
+			}
+		}
+	}
+	b.mu.Unlock()
+
+	if err := c.write(ack); err != nil {
+		return err
+	}
+	for _, r := range retained {
+		if err := c.write(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// publish stores the retained messages and delivers the message to the subscribed clients
+func (b *Broker) publish(p *packets.PublishPacket) {
+	type delivery struct {
+		c *client
+		p *packets.PublishPacket
+	}
+	var deliveries []delivery
+
+	b.mu.Lock()
+	if p.Retain {
+		// An empty retained message deletes the retained message of the topic
+		if len(p.Payload) == 0 {
+			delete(b.retained, p.TopicName)
+		} else {
+			b.retained[p.TopicName] = p.Copy()
+		}
+	}
+	for _, c := range b.clients {
+		qos, ok := byte(0), false
+		for filter, q := range c.subs {
+			if her.TopicMatches(filter, p.TopicName) {
+				if !ok || q > qos {
+					qos = q
+				}
+				ok = true
+			}
+		}
+		if ok {
+			deliveries = append(deliveries, delivery{c: c, p: b.delivery(c, p, qos, false)})
+		}
+	}
+	b.mu.Unlock()
+
+	for _, d := range deliveries {
+		if err := d.c.write(d.p); err != nil {
+			log.Warningf("MQTT broker: cannot deliver to %s: %v", d.c.id, err)
+			d.c.conn.Close()
+		}
+	}
+}
+
+// delivery returns the copy of the message to send to the client, with the QoS downgraded to the
+// granted one. It must be called holding the broker lock
+func (b *Broker) delivery(c *client, p *packets.PublishPacket, granted byte, retain bool) *packets.PublishPacket {
+	d := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	d.TopicName = p.TopicName
+	d.Payload = p.Payload
+	d.Qos = p.Qos
+	if d.Qos > granted {
+		d.Qos = granted
+	}
+	if d.Qos > 0 {
+		d.MessageID = c.messageID()
+	}
+	d.Retain = retain
+	return d
+}
+
+// disconnect unregisters the client, publishing its last will if it didn't disconnect cleanly
+func (b *Broker) disconnect(c *client) {
+	b.mu.Lock()
+	if b.clients[c.id] == c {
+		delete(b.clients, c.id)
+	}
+	will := c.will
+	closed := b.closed
+	b.mu.Unlock()
+
+	log.Debug("MQTT broker: client disconnected ", c.id)
+	if will != nil && !closed {
+		b.publish(will)
+	}
+}
+
+// validFilter checks the position of the wildcards in a topic filter
+func validFilter(filter string) bool {
+	if filter == "" {
+		return false
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if strings.Contains(level, "#") && (level != "#" || i != len(levels)-1) {
+			return false
+		}
+		if strings.Contains(level, "+") && level != "+" {
+			return false
+		}
+	}
+	return true
+}
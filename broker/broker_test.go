@@ -0,0 +1,261 @@
+package broker
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+func startBroker(t *testing.T, users map[string]string) *Broker {
+	b := New("127.0.0.1:0", users)
+	if err := b.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+	return b
+}
+
+func connect(t *testing.T, b *Broker, id, username, password string) (MQTT.Client, error) {
+	opts := MQTT.NewClientOptions().AddBroker("tcp://" + b.Addr().String())
+	opts.SetClientID(id)
+	opts.SetUsername(username)
+	opts.SetPassword(password)
+	opts.SetAutoReconnect(false)
+	c := MQTT.NewClient(opts)
+	token := c.Connect()
+	if !token.WaitTimeout(5 * time.Second) {
+		return nil, errors.New("connection timeout")
+	}
+	if token.Error() != nil {
+		return nil, token.Error()
+	}
+	t.Cleanup(func() { c.Disconnect(0) })
+	return c, nil
+}
+
+func subscribe(t *testing.T, c MQTT.Client, filter string, qos byte) chan MQTT.Message {
+	ch := make(chan MQTT.Message, 10)
+	token := c.Subscribe(filter, qos, func(_ MQTT.Client, m MQTT.Message) { ch <- m })
+	if !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("cannot subscribe %s: %v", filter, token.Error())
+	}
+	return ch
+}
+
+func publish(t *testing.T, c MQTT.Client, topic string, qos byte, retained bool, payload string) {
+	token := c.Publish(topic, qos, retained, payload)
+	if !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("cannot publish %s: %v", topic, token.Error())
+	}
+}
+
+func receive(t *testing.T, ch chan MQTT.Message) MQTT.Message {
+	select {
+	case m := <-ch:
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatalf("message not received")
+	}
+	return nil
+}
+
+func assertNothing(t *testing.T, ch chan MQTT.Message) {
+	select {
+	case m := <-ch:
+		t.Errorf("unexpected message %s %s", m.Topic(), m.Payload())
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestPublishSubscribe(t *testing.T) {
+	b := startBroker(t, nil)
+	sub, err := connect(t, b, "sub", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := connect(t, b, "pub", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ch := subscribe(t, sub, "zigbee2mqtt/+/temperature", 1)
+	all := subscribe(t, sub, "tasmota/#", 0)
+
+	publish(t, pub, "zigbee2mqtt/kitchen/temperature", 1, false, "21.5")
+	m := receive(t, ch)
+	if m.Topic() != "zigbee2mqtt/kitchen/temperature" || string(m.Payload()) != "21.5" || m.Qos() != 1 || m.Retained() {
+		t.Errorf("unexpected message %s %s qos=%d retained=%v", m.Topic(), m.Payload(), m.Qos(), m.Retained())
+	}
+
+	// QoS 2 publications are delivered with the granted QoS
+	publish(t, pub, "tasmota/light/POWER", 2, false, "ON")
+	if m := receive(t, all); string(m.Payload()) != "ON" || m.Qos() != 0 {
+		t.Errorf("unexpected message %s qos=%d", m.Payload(), m.Qos())
+	}
+
+	publish(t, pub, "zigbee2mqtt/kitchen/humidity", 0, false, "50")
+	assertNothing(t, ch)
+
+	if token := sub.Unsubscribe("zigbee2mqtt/+/temperature"); !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	publish(t, pub, "zigbee2mqtt/kitchen/temperature", 0, false, "22")
+	assertNothing(t, ch)
+}
+
+func TestRetained(t *testing.T) {
+	b := startBroker(t, nil)
+	pub, err := connect(t, b, "pub", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	publish(t, pub, "her/status", 1, true, "online")
+	publish(t, pub, "sensor/temperature", 0, true, "21")
+	publish(t, pub, "sensor/temperature", 0, true, "22")
+
+	sub, err := connect(t, b, "sub", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := subscribe(t, sub, "sensor/#", 1)
+	m := receive(t, ch)
+	if string(m.Payload()) != "22" || !m.Retained() {
+		t.Errorf("unexpected retained message %s retained=%v", m.Payload(), m.Retained())
+	}
+	assertNothing(t, ch)
+
+	// An empty retained message clears the topic
+	publish(t, pub, "sensor/temperature", 0, true, "")
+	receive(t, ch)
+	late, err := connect(t, b, "late", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertNothing(t, subscribe(t, late, "sensor/#", 1))
+}
+
+func TestAuthentication(t *testing.T) {
+	b := startBroker(t, map[string]string{"her": "secret"})
+
+	if _, err := connect(t, b, "anonymous", "", ""); !errors.Is(err, packets.ErrorRefusedNotAuthorised) {
+		t.Errorf("expected not authorised, got %v", err)
+	}
+	if _, err := connect(t, b, "wrong", "her", "wrong"); !errors.Is(err, packets.ErrorRefusedBadUsernameOrPassword) {
+		t.Errorf("expected bad username or password, got %v", err)
+	}
+	if _, err := connect(t, b, "her", "her", "secret"); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestWill(t *testing.T) {
+	b := startBroker(t, nil)
+	sub, err := connect(t, b, "sub", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := subscribe(t, sub, "her/status", 1)
+
+	// Connect with a raw connection, so that it can be dropped without DISCONNECT
+	conn, err := net.Dial("tcp", b.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	cp.ProtocolName = "MQTT"
+	cp.ProtocolVersion = 4
+	cp.CleanSession = true
+	cp.ClientIdentifier = "her"
+	cp.WillFlag = true
+	cp.WillTopic = "her/status"
+	cp.WillMessage = []byte("offline")
+	cp.WillQos = 1
+	if err := cp.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	if p, err := packets.ReadPacket(conn); err != nil || p.(*packets.ConnackPacket).ReturnCode != packets.Accepted {
+		t.Fatalf("connection not accepted: %v %v", p, err)
+	}
+	conn.Close()
+
+	if m := receive(t, ch); string(m.Payload()) != "offline" {
+		t.Errorf("unexpected will %s", m.Payload())
+	}
+}
+
+func TestQoS2(t *testing.T) {
+	b := startBroker(t, nil)
+	sub, err := connect(t, b, "sub", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := subscribe(t, sub, "light/set", 1)
+
+	conn, err := net.Dial("tcp", b.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	cp := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	cp.ProtocolName = "MQTT"
+	cp.ProtocolVersion = 4
+	cp.CleanSession = true
+	cp.ClientIdentifier = "pub"
+	if err := cp.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := packets.ReadPacket(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	// The publication is sent again before PUBREL, as after a lost PUBREC
+	for _, dup := range []bool{false, true} {
+		p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		p.TopicName = "light/set"
+		p.Payload = []byte("ON")
+		p.Qos = 2
+		p.MessageID = 7
+		p.Dup = dup
+		if err := p.Write(conn); err != nil {
+			t.Fatal(err)
+		}
+		if rec, err := packets.ReadPacket(conn); err != nil || rec.(*packets.PubrecPacket).MessageID != 7 {
+			t.Fatalf("unexpected PUBREC %v %v", rec, err)
+		}
+	}
+	assertNothing(t, ch)
+
+	rel := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+	rel.MessageID = 7
+	if err := rel.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	if comp, err := packets.ReadPacket(conn); err != nil || comp.(*packets.PubcompPacket).MessageID != 7 {
+		t.Fatalf("unexpected PUBCOMP %v %v", comp, err)
+	}
+	if m := receive(t, ch); string(m.Payload()) != "ON" {
+		t.Errorf("unexpected message %s", m.Payload())
+	}
+	assertNothing(t, ch)
+}
+
+func TestValidFilter(t *testing.T) {
+	for filter, want := range map[string]bool{
+		"a/b":   true,
+		"a/+/c": true,
+		"a/#":   true,
+		"#":     true,
+		"":      false,
+		"a/#/c": false,
+		"a/b#":  false,
+		"a+/b":  false,
+	} {
+		if got := validFilter(filter); got != want {
+			t.Errorf("validFilter(%q) = %v, want %v", filter, got, want)
+		}
+	}
+}
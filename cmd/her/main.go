@@ -2,19 +2,28 @@ package main
 
 import (
 	"flag"
+	"net"
 	"os"
 	"os/signal"
 	"sync"
 	"syscall"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 	"github.com/tommyblue/her/api"
 	"github.com/tommyblue/her/bot"
+	"github.com/tommyblue/her/broker"
+	"github.com/tommyblue/her/discovery"
 	"github.com/tommyblue/her/her"
 	"github.com/tommyblue/her/mqtt"
+	"github.com/tommyblue/her/rules"
+	"github.com/tommyblue/her/state"
 )
 
+// defaultSaveInterval is how often the state is saved when state.file is set
+const defaultSaveInterval = time.Minute
+
 // build is the git version of this program. It is set using build flags in the makefile.
 var build = "develop"
 var (
@@ -39,9 +48,13 @@ type mainConf struct {
 	messagesFromBotCh chan her.Message
 	shutdownCh        chan os.Signal
 	quitCh            chan bool
+	store             *state.Store
+	stateFile         string
+	broker            *broker.Broker
 	mqtt              *mqtt.Client
 	bot               *bot.Bot
 	server            *api.Server
+	rules             *rules.Engine
 }
 
 func main() {
@@ -57,12 +70,21 @@ func run() error {
 		messagesFromBotCh: make(chan her.Message),
 		shutdownCh:        make(chan os.Signal, 1),
 		quitCh:            make(chan bool, 1),
+		store:             state.NewStore(),
 	}
 
 	if err := c.setup(); err != nil {
 		return err
 	}
 
+	if err := c.initState(); err != nil {
+		return err
+	}
+
+	if err := c.initBroker(); err != nil {
+		return err
+	}
+
 	c.initMQTT()
 	c.initBot()
 	c.initServer(viper.GetString("general.host"), viper.GetInt("general.port"))
@@ -92,13 +114,82 @@ func (c *mainConf) setup() error {
 	return nil
 }
 
+// initState loads the state saved by the previous run and saves it periodically. The last save
+// happens at shutdown, once all the services are stopped
+func (c *mainConf) initState() error {
+	c.stateFile = viper.GetString("state.file")
+	if c.stateFile == "" {
+		return nil
+	}
+
+	if err := c.store.Load(c.stateFile); err != nil {
+		return err
+	}
+
+	interval := viper.GetDuration("state.save_interval")
+	if interval == 0 {
+		interval = defaultSaveInterval
+	}
+	ticker := time.NewTicker(interval)
+	go func() {
+		for range ticker.C {
+			c.saveState()
+		}
+	}()
+
+	return nil
+}
+
+func (c *mainConf) saveState() {
+	if c.stateFile == "" {
+		return
+	}
+	if err := c.store.Save(c.stateFile); err != nil {
+		log.Error(err)
+	}
+}
+
+// initBroker starts the embedded MQTT broker, if enabled. her connects to it unless another
+// broker_url is configured
+func (c *mainConf) initBroker() error {
+	if !viper.GetBool("broker.enabled") {
+		return nil
+	}
+
+	addr := viper.GetString("broker.listen")
+	if addr == "" {
+		addr = "127.0.0.1:1883"
+	}
+	// viper lowercases the keys, so the user names too
+	users := viper.GetStringMapString("broker.users")
+	c.broker = broker.New(addr, users)
+	if err := c.broker.Start(); err != nil {
+		return err
+	}
+	// Anyone who can reach the broker can publish the commands
+	if host, _, err := net.SplitHostPort(c.broker.Addr().String()); err == nil && len(users) == 0 {
+		if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+			log.Warning("The MQTT broker listens on ", c.broker.Addr(), " without authentication, set broker.users")
+		}
+	}
+
+	if viper.GetString("mqtt.broker_url") == "" {
+		_, port, err := net.SplitHostPort(c.broker.Addr().String())
+		if err != nil {
+			return err
+		}
+		viper.Set("mqtt.broker_url", "tcp://127.0.0.1:"+port)
+	}
+	return nil
+}
+
 func (c *mainConf) initMQTT() {
 	c.startWg.Add(1)
 	c.stopWg.Add(1)
 	go func() {
 		defer c.startWg.Done()
 		log.Info("Initializing mqtt")
-		m, err := mqtt.NewClient(&c.stopWg, c.shutdownCh, c.messagesFromBotCh, c.messagesToBotCh)
+		m, err := mqtt.NewClient(&c.stopWg, c.shutdownCh, c.messagesFromBotCh, c.messagesToBotCh, c.store)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -112,7 +203,7 @@ func (c *mainConf) initBot() {
 	go func() {
 		defer c.startWg.Done()
 		log.Info("Initializing bot")
-		b, err := bot.NewBot(&c.stopWg, c.shutdownCh, c.messagesFromBotCh, c.messagesToBotCh)
+		b, err := bot.NewBot(&c.stopWg, c.shutdownCh, c.messagesFromBotCh, c.messagesToBotCh, c.store)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -125,7 +216,7 @@ func (c *mainConf) initServer(host string, port int) {
 	go func() {
 		defer c.startWg.Done()
 		log.Info("Initializing server")
-		s, err := api.NewServer(host, port, c.messagesFromBotCh)
+		s, err := api.NewServer(host, port, c.messagesFromBotCh, c.store)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -137,10 +228,24 @@ func (c *mainConf) manageShutdown() {
 	go func() {
 		<-c.shutdownCh
 		log.Info("CTRL+C caught, doing clean shutdown (use CTRL+\\ aka SIGQUIT to abort)")
+		if c.rules != nil {
+			// Rules send to the channels closed below
+			c.rules.Stop()
+		}
+		if c.mqtt != nil {
+			// Like the rules, paho handlers can still send to the bot
+			c.mqtt.StopSending()
+		}
 		close(c.shutdownCh)
 		close(c.messagesToBotCh)
 		close(c.messagesFromBotCh)
 		c.stopWg.Wait()
+		c.saveState()
+		if c.broker != nil {
+			if err := c.broker.Close(); err != nil {
+				log.Error(err)
+			}
+		}
 		c.quitCh <- true
 	}()
 }
@@ -156,12 +261,26 @@ func (c *mainConf) runServices() error {
 		return err
 	}
 	for _, s := range subscriptionConfs {
+		if err := validateSubscription(s); err != nil {
+			return err
+		}
 		if err := c.mqtt.Subscribe(s); err != nil {
 			log.Error(err)
 			return err
 		}
 	}
 
+	var conditionConfs []her.ConditionConf
+	if err := viper.UnmarshalKey("conditions", &conditionConfs); err != nil {
+		return err
+	}
+	for _, conditionConf := range conditionConfs {
+		if err := c.mqtt.AddCondition(conditionConf); err != nil {
+			log.Error(err)
+			return err
+		}
+	}
+
 	var commandConfs []her.CommandConf
 	if err := viper.UnmarshalKey("commands", &commandConfs); err != nil {
 		return err
@@ -174,6 +293,35 @@ func (c *mainConf) runServices() error {
 			log.Error(err)
 			return err
 		}
+		if commandConf.StateTopic != "" {
+			if err := c.mqtt.Watch(commandConf.StateTopic); err != nil {
+				log.Error(err)
+				return err
+			}
+		}
+	}
+
+	var ruleConfs []her.RuleConf
+	if err := viper.UnmarshalKey("rules", &ruleConfs); err != nil {
+		return err
+	}
+	engine, err := rules.New(c.mqtt, c.store, c.messagesFromBotCh, c.messagesToBotCh, ruleConfs, commandConfs)
+	if err != nil {
+		return err
+	}
+	c.mqtt.Observe(engine.Handle)
+	engine.Start()
+	c.rules = engine
+
+	d, err := discovery.New(c.mqtt, c.bot)
+	if err != nil {
+		return err
+	}
+	if d.Enabled() {
+		if err := d.Start(); err != nil {
+			log.Error(err)
+			return err
+		}
 	}
 
 	c.server.Start()
@@ -8,7 +8,9 @@ import (
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
+	"github.com/tommyblue/her/alarm"
 	"github.com/tommyblue/her/her"
+	"github.com/tommyblue/her/quiet"
 )
 
 func validateCommand(command her.CommandConf) error {
@@ -28,6 +30,44 @@ func validateCommand(command her.CommandConf) error {
 		return fmt.Errorf("command /%s is missing the message", command.Command)
 	}
 
+	if !her.ValidQoS(command.QoS) {
+		return fmt.Errorf("command /%s has an invalid qos %d", command.Command, *command.QoS)
+	}
+
+	if command.StateTopic == "" && (command.StatePayload != "" || command.ConfirmTimeout != 0) {
+		return fmt.Errorf("command /%s needs a state_topic to be confirmed", command.Command)
+	}
+
+	if command.ConfirmTimeout < 0 {
+		return fmt.Errorf("command /%s has a negative confirm_timeout", command.Command)
+	}
+
+	return nil
+}
+
+func validateSubscription(subscription her.SubscriptionConf) error {
+	if subscription.Topic == "" {
+		return fmt.Errorf("subscription %s is missing the topic", subscription.Label)
+	}
+
+	if !her.ValidQoS(subscription.QoS) {
+		return fmt.Errorf("subscription %s has an invalid qos %d", subscription.Topic, *subscription.QoS)
+	}
+
+	if subscription.MaxSilence < 0 {
+		return fmt.Errorf("subscription %s has a negative max_silence", subscription.Topic)
+	}
+
+	if _, err := alarm.CompileAll(subscription.AlarmConfs()); err != nil {
+		return fmt.Errorf("subscription %s: %w", subscription.Topic, err)
+	}
+
+	if subscription.QuietHours != nil {
+		if _, err := quiet.Compile(*subscription.QuietHours); err != nil {
+			return fmt.Errorf("subscription %s: %w", subscription.Topic, err)
+		}
+	}
+
 	return nil
 }
 
@@ -3,6 +3,11 @@ package main
 import (
 	"fmt"
 	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/tommyblue/her/her"
+	"github.com/tommyblue/her/notify"
 )
 
 func Test_loadConfig(t *testing.T) {
@@ -15,4 +20,106 @@ func Test_loadConfig(t *testing.T) {
 	if err != nil {
 		t.Errorf("Unexpected error %v", err)
 	}
+
+	// The example shows the default templates
+	defaults := map[string]string{
+		"notification": notify.DefaultNotification,
+		"alarm":        notify.DefaultAlarm,
+		"recovery":     notify.DefaultRecovery,
+		"status":       notify.DefaultStatus,
+	}
+	for name, want := range defaults {
+		if got := viper.GetString("templates." + name); got != want {
+			t.Errorf("templates.%s = %q, want the default %q", name, got, want)
+		}
+	}
+}
+
+func Test_validateQoS(t *testing.T) {
+	valid := byte(2)
+	invalid := byte(3)
+
+	command := her.CommandConf{Command: "on", Topic: "t", Message: "ON", Help: "h", QoS: &valid}
+	if err := validateCommand(command); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	command.QoS = &invalid
+	if err := validateCommand(command); err == nil {
+		t.Error("Expected error")
+	}
+
+	command = her.CommandConf{Command: "on", Topic: "t", Message: "ON", Help: "h", StatePayload: "ON"}
+	if err := validateCommand(command); err == nil {
+		t.Error("Expected error for a state_payload without state_topic")
+	}
+	command.StateTopic = "stat"
+	if err := validateCommand(command); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	subscription := her.SubscriptionConf{Topic: "t", QoS: &valid}
+	if err := validateSubscription(subscription); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	subscription.QoS = &invalid
+	if err := validateSubscription(subscription); err == nil {
+		t.Error("Expected error")
+	}
+}
+
+func Test_validateSubscriptionMaxSilence(t *testing.T) {
+	if err := validateSubscription(her.SubscriptionConf{Topic: "t", MaxSilence: time.Hour}); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if err := validateSubscription(her.SubscriptionConf{Topic: "t", MaxSilence: -time.Hour}); err == nil {
+		t.Error("Expected error for a negative max_silence")
+	}
+}
+
+func Test_validateSubscriptionQuietHours(t *testing.T) {
+	quiet := &her.QuietHoursConf{Start: "22:00", End: "07:00", Timezone: "UTC"}
+	if err := validateSubscription(her.SubscriptionConf{Topic: "t", QuietHours: quiet}); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	quiet.End = "25:00"
+	if err := validateSubscription(her.SubscriptionConf{Topic: "t", QuietHours: quiet}); err == nil {
+		t.Error("Expected error for an invalid end")
+	}
+}
+
+func Test_validateSubscriptionAlarm(t *testing.T) {
+	tests := []struct {
+		alarm   her.AlarmConf
+		wantErr bool
+	}{
+		{her.AlarmConf{Operator: "greater_than", Value: 20}, false},
+		{her.AlarmConf{Operator: "between", Min: 18, Max: 24}, false},
+		{her.AlarmConf{Operator: "between", Min: 24, Max: 18}, true},
+		{her.AlarmConf{Operator: "matches", Text: `"status":\s*"error"`}, false},
+		{her.AlarmConf{Operator: "matches", Text: "("}, true},
+		{her.AlarmConf{Operator: "bigger_than", Value: 20}, true},
+	}
+	for _, tt := range tests {
+		alarm := tt.alarm
+		err := validateSubscription(her.SubscriptionConf{Topic: "t", Alarm: &alarm})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("validateSubscription(%+v) error = %v, wantErr %v", tt.alarm, err, tt.wantErr)
+		}
+	}
+
+	alarms := []her.AlarmConf{
+		{Name: "warm", Operator: "greater_than", Value: 25},
+		{Name: "hot", Severity: "critical", Operator: "greater_than", Value: 30},
+	}
+	if err := validateSubscription(her.SubscriptionConf{Topic: "t", Alarms: alarms}); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	alarms[1].Severity = "fatal"
+	if err := validateSubscription(her.SubscriptionConf{Topic: "t", Alarms: alarms}); err == nil {
+		t.Error("Expected error for an unknown severity")
+	}
+	alarms[1] = her.AlarmConf{Operator: "greater_than", Value: 30}
+	if err := validateSubscription(her.SubscriptionConf{Topic: "t", Alarm: &alarms[1], Alarms: alarms}); err == nil {
+		t.Error("Expected error for duplicated names")
+	}
 }
@@ -0,0 +1,376 @@
+package discovery
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/tommyblue/her/her"
+)
+
+// Subscriber is the part of the MQTT client used by the discovery
+type Subscriber interface {
+	Subscribe(her.SubscriptionConf) error
+	Unsubscribe(her.SubscriptionConf) error
+	Listen(filter string, handler func(topic string, payload []byte)) error
+}
+
+// Commander is the part of the bot used by the discovery
+type Commander interface {
+	AddCommand(her.CommandConf) error
+	RemoveCommand(string) error
+}
+
+type Conf struct {
+	Enabled               bool
+	Prefix                string
+	Include               []string // Entity id patterns (e.g. "sensor.kitchen_*") to expose, all if empty
+	Exclude               []string // Entity id patterns to ignore
+	Repeat                bool     // Repeat setting of the generated subscriptions
+	RepeatOnlyIfDifferent bool     `mapstructure:"repeat_only_if_different"`
+}
+
+// Discovery consumes the Home Assistant MQTT discovery messages, published at
+// <prefix>/<component>/[<node_id>/]<object_id>/config, and keeps subscriptions and commands in sync
+// with the discovered sensors, binary sensors and switches
+type Discovery struct {
+	conf       Conf
+	subscriber Subscriber
+	commander  Commander
+	entities   map[string]entity
+	mu         sync.Mutex
+	pending    []message
+	notifyCh   chan struct{}
+}
+
+// entity is what has been registered for a discovery topic
+type entity struct {
+	subscription *her.SubscriptionConf
+	commands     []string
+}
+
+type message struct {
+	topic   string
+	payload []byte
+}
+
+func New(subscriber Subscriber, commander Commander) (*Discovery, error) {
+	d := &Discovery{
+		subscriber: subscriber,
+		commander:  commander,
+		entities:   make(map[string]entity),
+		notifyCh:   make(chan struct{}, 1),
+	}
+
+	if err := viper.UnmarshalKey("discovery", &d.conf); err != nil {
+		return nil, err
+	}
+	if d.conf.Prefix == "" {
+		d.conf.Prefix = "homeassistant"
+	}
+	for _, pattern := range append(d.conf.Include, d.conf.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid discovery pattern %s: %w", pattern, err)
+		}
+	}
+
+	return d, nil
+}
+
+// Enabled reports whether the discovery is enabled in the config
+func (d *Discovery) Enabled() bool {
+	return d.conf.Enabled
+}
+
+// Start listens for the discovery messages. They are handled in a dedicated goroutine, as paho
+// handlers must not block while subscribing
+func (d *Discovery) Start() error {
+	go d.run()
+
+	for _, filter := range []string{d.conf.Prefix + "/+/+/config", d.conf.Prefix + "/+/+/+/config"} {
+		if err := d.subscriber.Listen(filter, d.enqueue); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *Discovery) enqueue(topic string, payload []byte) {
+	d.mu.Lock()
+	d.pending = append(d.pending, message{topic: topic, payload: payload})
+	d.mu.Unlock()
+
+	select {
+	case d.notifyCh <- struct{}{}:
+	default:
+	}
+}
+
+func (d *Discovery) run() {
+	for range d.notifyCh {
+		d.mu.Lock()
+		pending := d.pending
+		d.pending = nil
+		d.mu.Unlock()
+
+		for _, m := range pending {
+			if err := d.handle(m.topic, m.payload); err != nil {
+				log.Error(err)
+			}
+		}
+	}
+}
+
+// handle applies a discovery message. An empty payload means the entity has been removed, any other
+// payload replaces the previous configuration of the entity
+func (d *Discovery) handle(topic string, payload []byte) error {
+	component, objectID, ok := d.parseTopic(topic)
+	if !ok {
+		return fmt.Errorf("invalid discovery topic %s", topic)
+	}
+
+	if err := d.remove(topic); err != nil {
+		return err
+	}
+	if len(payload) == 0 {
+		return nil
+	}
+
+	entityID := fmt.Sprintf("%s.%s", component, objectID)
+	if !d.exposed(entityID) {
+		log.Debug("Discovery: ignoring ", entityID)
+		return nil
+	}
+
+	conf, err := parseConfig(payload)
+	if err != nil {
+		return fmt.Errorf("invalid discovery config for %s: %w", entityID, err)
+	}
+
+	var (
+		e            entity
+		subscription *her.SubscriptionConf
+		commands     []her.CommandConf
+	)
+	switch component {
+	case "sensor", "binary_sensor":
+		if conf.StateTopic == "" {
+			return fmt.Errorf("discovery: %s has no state topic", entityID)
+		}
+		subscription = d.subscription(conf, objectID)
+	case "switch":
+		if conf.CommandTopic == "" {
+			return fmt.Errorf("discovery: %s has no command topic", entityID)
+		}
+		if conf.StateTopic != "" {
+			subscription = d.subscription(conf, objectID)
+		}
+		name := commandName(objectID)
+		commands = []her.CommandConf{
+			{Command: name + "_on", Topic: conf.CommandTopic, Message: conf.PayloadOn, Help: "Switch on " + conf.label(objectID)},
+			{Command: name + "_off", Topic: conf.CommandTopic, Message: conf.PayloadOff, Help: "Switch off " + conf.label(objectID)},
+		}
+	default:
+		log.Debug("Discovery: unsupported component ", component)
+		return nil
+	}
+
+	if err := d.register(&e, subscription, commands); err != nil {
+		return fmt.Errorf("discovery: cannot add %s: %w", entityID, err)
+	}
+	log.Info("Discovery: added ", entityID)
+	d.entities[topic] = e
+	return nil
+}
+
+// register adds the commands and the subscription of the entity. If any fails, those already
+// added are removed. Commands named like the configured ones are refused by the bot
+func (d *Discovery) register(e *entity, subscription *her.SubscriptionConf, commands []her.CommandConf) error {
+	for _, c := range commands {
+		c.FeedbackMsg = c.Help
+		if err := d.commander.AddCommand(c); err != nil {
+			d.rollback(*e)
+			return err
+		}
+		e.commands = append(e.commands, c.Command)
+	}
+	if subscription != nil {
+		if err := d.subscriber.Subscribe(*subscription); err != nil {
+			d.rollback(*e)
+			return err
+		}
+		e.subscription = subscription
+	}
+	return nil
+}
+
+func (d *Discovery) rollback(e entity) {
+	if err := d.unregister(e); err != nil {
+		log.Error("Discovery: ", err)
+	}
+}
+
+func (d *Discovery) remove(topic string) error {
+	e, ok := d.entities[topic]
+	if !ok {
+		return nil
+	}
+	delete(d.entities, topic)
+	log.Info("Discovery: removing ", topic)
+	return d.unregister(e)
+}
+
+// unregister removes the subscription and the commands of the entity, trying all of them even if
+// one fails
+func (d *Discovery) unregister(e entity) error {
+	var errs []error
+	if e.subscription != nil {
+		if err := d.subscriber.Unsubscribe(*e.subscription); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, c := range e.commands {
+		if err := d.commander.RemoveCommand(c); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (d *Discovery) subscription(conf entityConf, objectID string) *her.SubscriptionConf {
+	jsonPath, ok := templateJSONPath(conf.ValueTemplate)
+	if !ok {
+		log.Warningf("Discovery: unsupported value template %q, the raw payload will be used", conf.ValueTemplate)
+	}
+	return &her.SubscriptionConf{
+		Label:                 conf.label(objectID),
+		Topic:                 conf.StateTopic,
+		JSONPath:              jsonPath,
+		Repeat:                d.conf.Repeat,
+		RepeatOnlyIfDifferent: d.conf.RepeatOnlyIfDifferent,
+		Discovered:            true,
+	}
+}
+
+// parseTopic returns the component and the object id of a discovery topic
+func (d *Discovery) parseTopic(topic string) (string, string, bool) {
+	levels := strings.Split(strings.TrimPrefix(topic, d.conf.Prefix+"/"), "/")
+	if len(levels) < 3 || len(levels) > 4 || levels[len(levels)-1] != "config" {
+		return "", "", false
+	}
+	return levels[0], levels[len(levels)-2], true
+}
+
+func (d *Discovery) exposed(entityID string) bool {
+	for _, pattern := range d.conf.Exclude {
+		if ok, _ := path.Match(pattern, entityID); ok {
+			return false
+		}
+	}
+	if len(d.conf.Include) == 0 {
+		return true
+	}
+	for _, pattern := range d.conf.Include {
+		if ok, _ := path.Match(pattern, entityID); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// entityConf is the subset of the discovery payload used by her
+type entityConf struct {
+	Name          string `json:"name"`
+	StateTopic    string `json:"state_topic"`
+	CommandTopic  string `json:"command_topic"`
+	PayloadOn     string `json:"payload_on"`
+	PayloadOff    string `json:"payload_off"`
+	ValueTemplate string `json:"value_template"`
+	Device        struct {
+		Name string `json:"name"`
+	} `json:"device"`
+}
+
+func (c entityConf) label(objectID string) string {
+	if c.Name != "" {
+		return c.Name
+	}
+	if c.Device.Name != "" {
+		return c.Device.Name
+	}
+	return objectID
+}
+
+// abbreviations maps the abbreviated discovery keys to the full ones
+var abbreviations = map[string]string{
+	"stat_t":  "state_topic",
+	"cmd_t":   "command_topic",
+	"pl_on":   "payload_on",
+	"pl_off":  "payload_off",
+	"val_tpl": "value_template",
+	"dev":     "device",
+}
+
+// parseConfig decodes a discovery payload, expanding the abbreviated keys and the ~ base topic
+func parseConfig(payload []byte) (entityConf, error) {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(payload, &raw); err != nil {
+		return entityConf{}, err
+	}
+
+	base, _ := raw["~"].(string)
+	expanded := make(map[string]interface{}, len(raw))
+	for k, v := range raw {
+		if full, ok := abbreviations[k]; ok {
+			k = full
+		}
+		if s, ok := v.(string); ok && base != "" && strings.HasSuffix(k, "_topic") {
+			if strings.HasPrefix(s, "~") {
+				s = base + s[1:]
+			} else if strings.HasSuffix(s, "~") {
+				s = s[:len(s)-1] + base
+			}
+			v = s
+		}
+		expanded[k] = v
+	}
+
+	data, err := json.Marshal(expanded)
+	if err != nil {
+		return entityConf{}, err
+	}
+	conf := entityConf{PayloadOn: "ON", PayloadOff: "OFF"}
+	if err := json.Unmarshal(data, &conf); err != nil {
+		return entityConf{}, err
+	}
+	return conf, nil
+}
+
+var valueJSONRegexp = regexp.MustCompile(`^\{\{\s*value_json((?:\.[A-Za-z_][A-Za-z0-9_]*|\[\d+\])+)\s*\}\}$`)
+
+// templateJSONPath converts the simple value templates, like "{{ value_json.temperature }}", to a
+// JSON path. It returns false if the template can't be converted
+func templateJSONPath(template string) (string, bool) {
+	template = strings.TrimSpace(template)
+	if template == "" || template == "{{ value }}" {
+		return "", true
+	}
+	m := valueJSONRegexp.FindStringSubmatch(template)
+	if m == nil {
+		return "", false
+	}
+	return strings.TrimPrefix(m[1], "."), true
+}
+
+var commandNameRegexp = regexp.MustCompile(`[^a-z0-9_]+`)
+
+// commandName converts the object id to a valid bot command
+func commandName(objectID string) string {
+	return commandNameRegexp.ReplaceAllString(strings.ToLower(objectID), "_")
+}
@@ -0,0 +1,196 @@
+package discovery
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/tommyblue/her/her"
+)
+
+type subscriberMock struct {
+	subscriptions map[string]her.SubscriptionConf
+	listened      []string
+}
+
+func (s *subscriberMock) Subscribe(c her.SubscriptionConf) error {
+	s.subscriptions[c.Label] = c
+	return nil
+}
+func (s *subscriberMock) Unsubscribe(c her.SubscriptionConf) error {
+	delete(s.subscriptions, c.Label)
+	return nil
+}
+func (s *subscriberMock) Listen(filter string, handler func(string, []byte)) error {
+	s.listened = append(s.listened, filter)
+	return nil
+}
+
+type commanderMock struct {
+	commands map[string]her.CommandConf
+}
+
+func (c *commanderMock) AddCommand(conf her.CommandConf) error {
+	if _, ok := c.commands[conf.Command]; ok {
+		return fmt.Errorf("command %s already exists", conf.Command)
+	}
+	c.commands[conf.Command] = conf
+	return nil
+}
+func (c *commanderMock) RemoveCommand(command string) error {
+	delete(c.commands, command)
+	return nil
+}
+
+func newDiscovery(conf Conf) (*Discovery, *subscriberMock, *commanderMock) {
+	s := &subscriberMock{subscriptions: make(map[string]her.SubscriptionConf)}
+	c := &commanderMock{commands: make(map[string]her.CommandConf)}
+	if conf.Prefix == "" {
+		conf.Prefix = "homeassistant"
+	}
+	return &Discovery{
+		conf:       conf,
+		subscriber: s,
+		commander:  c,
+		entities:   make(map[string]entity),
+		notifyCh:   make(chan struct{}, 1),
+	}, s, c
+}
+
+func TestHandle(t *testing.T) {
+	d, s, c := newDiscovery(Conf{Repeat: true})
+
+	sensor := `{"name": "Kitchen temperature", "stat_t": "~/state", "~": "zigbee2mqtt/kitchen", "val_tpl": "{{ value_json.temperature }}"}`
+	if err := d.handle("homeassistant/sensor/kitchen/temperature/config", []byte(sensor)); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	got := s.subscriptions["Kitchen temperature"]
+	want := her.SubscriptionConf{Label: "Kitchen temperature", Topic: "zigbee2mqtt/kitchen/state", JSONPath: "temperature", Repeat: true, Discovered: true}
+	if fmt.Sprintf("%+v", got) != fmt.Sprintf("%+v", want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	light := `{"name": "Kitchen light", "state_topic": "tasmota/light/state", "command_topic": "tasmota/light/cmd", "payload_on": "1", "payload_off": "0"}`
+	if err := d.handle("homeassistant/switch/kitchen-light/config", []byte(light)); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if _, ok := s.subscriptions["Kitchen light"]; !ok {
+		t.Errorf("Switch state not subscribed")
+	}
+	on, ok := c.commands["kitchen_light_on"]
+	if !ok || on.Topic != "tasmota/light/cmd" || on.Message != "1" {
+		t.Errorf("unexpected on command %+v", on)
+	}
+	if off := c.commands["kitchen_light_off"]; off.Message != "0" {
+		t.Errorf("unexpected off command %+v", off)
+	}
+
+	// Updating the config replaces the entity
+	light = `{"name": "Kitchen light", "state_topic": "tasmota/light/state", "command_topic": "tasmota/light/cmd2"}`
+	if err := d.handle("homeassistant/switch/kitchen-light/config", []byte(light)); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if on := c.commands["kitchen_light_on"]; on.Topic != "tasmota/light/cmd2" || on.Message != "ON" {
+		t.Errorf("unexpected on command %+v", on)
+	}
+
+	// Empty payloads remove the entity
+	if err := d.handle("homeassistant/switch/kitchen-light/config", nil); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if len(c.commands) != 0 {
+		t.Errorf("Commands not removed: %v", c.commands)
+	}
+	if _, ok := s.subscriptions["Kitchen light"]; ok {
+		t.Errorf("Subscription not removed")
+	}
+
+	// Unsupported components and invalid payloads
+	if err := d.handle("homeassistant/light/kitchen/config", []byte(`{"name": "light"}`)); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if err := d.handle("homeassistant/sensor/kitchen/config", []byte(`{`)); err == nil {
+		t.Errorf("Expected error")
+	}
+	if err := d.handle("homeassistant/sensor/kitchen/config", []byte(`{"name": "no state"}`)); err == nil {
+		t.Errorf("Expected error")
+	}
+	if err := d.handle("homeassistant/sensor/config", []byte(`{}`)); err == nil {
+		t.Errorf("Expected error")
+	}
+}
+
+func TestRollback(t *testing.T) {
+	d, s, c := newDiscovery(Conf{})
+	configured := her.CommandConf{Command: "garage_off", Topic: "garage/cmd", Message: "CLOSE"}
+	c.commands["garage_off"] = configured
+
+	garage := `{"name": "Garage", "state_topic": "garage/state", "command_topic": "shelly/garage/cmd"}`
+	if err := d.handle("homeassistant/switch/garage/config", []byte(garage)); err == nil {
+		t.Fatal("Expected error for a command named like a configured one")
+	}
+	if len(c.commands) != 1 || c.commands["garage_off"] != configured {
+		t.Errorf("unexpected commands %v", c.commands)
+	}
+	if len(s.subscriptions) != 0 || len(d.entities) != 0 {
+		t.Errorf("Entity partially registered: %v %v", s.subscriptions, d.entities)
+	}
+}
+
+func TestFilters(t *testing.T) {
+	d, s, _ := newDiscovery(Conf{
+		Include: []string{"sensor.*", "binary_sensor.door_*"},
+		Exclude: []string{"sensor.*_battery"},
+	})
+
+	for _, id := range []string{"temperature", "phone_battery", "door_kitchen", "window_kitchen"} {
+		for _, component := range []string{"sensor", "binary_sensor"} {
+			payload := fmt.Sprintf(`{"name": "%s.%s", "state_topic": "state/%s"}`, component, id, id)
+			if err := d.handle(fmt.Sprintf("homeassistant/%s/%s/config", component, id), []byte(payload)); err != nil {
+				t.Fatalf("Unexpected error %v", err)
+			}
+		}
+	}
+
+	var got []string
+	for label := range s.subscriptions {
+		got = append(got, label)
+	}
+	sort.Strings(got)
+	want := []string{"binary_sensor.door_kitchen", "sensor.door_kitchen", "sensor.temperature", "sensor.window_kitchen"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestStart(t *testing.T) {
+	d, s, _ := newDiscovery(Conf{Prefix: "ha"})
+	if err := d.Start(); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	want := []string{"ha/+/+/config", "ha/+/+/+/config"}
+	if fmt.Sprint(s.listened) != fmt.Sprint(want) {
+		t.Errorf("got %v, want %v", s.listened, want)
+	}
+}
+
+func TestTemplateJSONPath(t *testing.T) {
+	tests := []struct {
+		template string
+		want     string
+		ok       bool
+	}{
+		{"", "", true},
+		{"{{ value }}", "", true},
+		{"{{ value_json.temperature }}", "temperature", true},
+		{"{{value_json.state.power[0]}}", "state.power[0]", true},
+		{"{{ value_json.temperature | round(1) }}", "", false},
+		{"{{ value_json['temperature'] }}", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := templateJSONPath(tt.template)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("templateJSONPath(%q) = %q, %v, want %q, %v", tt.template, got, ok, tt.want, tt.ok)
+		}
+	}
+}
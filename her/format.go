@@ -0,0 +1,45 @@
+package her
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Convert applies the scale and offset to numeric values, leaving the others untouched
+func (s SubscriptionConf) Convert(value []byte) []byte {
+	if s.Scale == nil && s.Offset == 0 {
+		return value
+	}
+	v, err := strconv.ParseFloat(strings.TrimSpace(string(value)), 64)
+	if err != nil {
+		return value
+	}
+	if s.Scale != nil {
+		v *= *s.Scale
+	}
+	v += s.Offset
+	return []byte(strconv.FormatFloat(v, 'f', -1, 64))
+}
+
+// Display returns the value as shown to the user: replaced according to the values map or, if
+// numeric, converted and rounded to the precision
+func (s SubscriptionConf) Display(value []byte) string {
+	raw := strings.TrimSpace(string(value))
+	if mapped, ok := s.Values[raw]; ok {
+		return mapped
+	}
+	// The config keys are lowercased when loaded
+	if mapped, ok := s.Values[strings.ToLower(raw)]; ok {
+		return mapped
+	}
+
+	converted := string(s.Convert(value))
+	if s.Precision == nil {
+		return converted
+	}
+	v, err := strconv.ParseFloat(converted, 64)
+	if err != nil {
+		return converted
+	}
+	return strconv.FormatFloat(v, 'f', *s.Precision, 64)
+}
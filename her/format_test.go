@@ -0,0 +1,45 @@
+package her
+
+import "testing"
+
+func TestDisplay(t *testing.T) {
+	precision := 1
+	noDecimals := 0
+	scale := 0.001
+
+	tests := []struct {
+		name  string
+		s     SubscriptionConf
+		value string
+		want  string
+	}{
+		{"raw", SubscriptionConf{}, "21.456", "21.456"},
+		{"mapped", SubscriptionConf{Values: map[string]string{"ON": "open"}}, "ON", "open"},
+		{"mapped lowercased keys", SubscriptionConf{Values: map[string]string{"off": "closed"}}, "OFF", "closed"},
+		{"mapped number", SubscriptionConf{Values: map[string]string{"1": "open"}, Precision: &precision}, "1", "open"},
+		{"not mapped", SubscriptionConf{Values: map[string]string{"on": "open"}}, "UNKNOWN", "UNKNOWN"},
+		{"precision", SubscriptionConf{Precision: &precision}, "21.456", "21.5"},
+		{"no decimals", SubscriptionConf{Precision: &noDecimals}, "21.5", "22"},
+		{"scale", SubscriptionConf{Scale: &scale, Precision: &precision}, "1520", "1.5"},
+		{"offset", SubscriptionConf{Offset: -0.5}, "21", "20.5"},
+		{"not numeric", SubscriptionConf{Scale: &scale, Precision: &precision}, "n/a", "n/a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.s.Display([]byte(tt.value)); got != tt.want {
+				t.Errorf("Display(%q) = %q, want %q", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConvert(t *testing.T) {
+	scale := 0.1
+	s := SubscriptionConf{Scale: &scale, Offset: 1}
+	if got := string(s.Convert([]byte("215"))); got != "22.5" {
+		t.Errorf("unexpected value %s", got)
+	}
+	if got := string(SubscriptionConf{}.Convert([]byte("215"))); got != "215" {
+		t.Errorf("unexpected value %s", got)
+	}
+}
@@ -1,25 +1,99 @@
 package her
 
+import (
+	"fmt"
+	"time"
+)
+
+// DefaultConfirmTimeout is how long to wait for a device to confirm a command
+const DefaultConfirmTimeout = 5 * time.Second
+
 type Message struct {
 	Topic   string
 	Message []byte
 	Command string
+	Text    string // Notification already formatted, sent to the bot as is
+	ChatID  int64  // Chat to notify instead of the default one
+	AlarmID string // Alarm that can be acknowledged from the notification, see AlarmID
+	QoS     *byte  // Publish QoS, nil to use the mqtt.qos default
+	Retain  *bool  // Publish retain flag, nil to use the mqtt.retain default
+	// Result, if set, receives the outcome of the publish. It must be buffered
+	Result chan<- PublishResult
+	// Confirm, if set, delays the Result until the device reports the expected state or times out
+	Confirm *Confirmation
+}
+
+// Confirmation is the state a device is expected to report after receiving a command
+type Confirmation struct {
+	Topic   string
+	Payload string
+	Timeout time.Duration
+}
+
+type PublishStatus int
+
+const (
+	Published PublishStatus = iota
+	Queued                  // The broker is unreachable, the message will be published on reconnection
+	Failed
+)
+
+type PublishResult struct {
+	Status    PublishStatus
+	Err       error
+	Confirmed bool // The device reported the expected state, only when a confirmation was requested
 }
 
 type SubscriptionConf struct {
 	Label                 string
 	Topic                 string
 	Repeat                bool
-	RepeatOnlyIfDifferent bool `mapstructure:"repeat_only_if_different"`
-	Alarm                 *AlarmConf
+	RepeatOnlyIfDifferent bool        `mapstructure:"repeat_only_if_different"`
+	Alarm                 *AlarmConf  // Single alarm, kept for compatibility with the older configs
+	Alarms                []AlarmConf // Many alarms, e.g. a warning and a critical threshold
+	QoS                   *byte       `mapstructure:"qos"`
+	Retain                *bool       // Process the retained messages sent by the broker when subscribing
+	JSONPath              string      `mapstructure:"json_path"` // Path of the value in JSON payloads
+	Unit                  string
+	Values                map[string]string // Replace raw values, e.g. ON with "open"
+	Precision             *int              // Decimals of numeric values, as received if nil
+	Scale                 *float64          // Multiply numeric values, before adding the offset
+	Offset                float64
+	Templates             TemplatesConf   // Override the global templates
+	MaxSilence            time.Duration   `mapstructure:"max_silence"` // Alert when nothing is received for longer
+	QuietHours            *QuietHoursConf `mapstructure:"quiet_hours"` // Override the global quiet hours
+	Discovered            bool            `mapstructure:"-"`           // Registered by the discovery, which can remove it
+}
+
+// QuietHoursConf holds back the notifications between Start and End, e.g. 22:00 and 07:00, sending
+// them as a summary when the quiet hours end
+type QuietHoursConf struct {
+	Start    string
+	End      string
+	Timezone string // IANA name like Europe/Rome, the local time if empty
+	Bypass   string // Alarms of this severity or worse are sent anyway, critical if empty
+}
+
+// TemplatesConf holds the text/template sources of the messages, empty ones use the defaults
+type TemplatesConf struct {
+	Notification string // Sent when a value is received
+	Alarm        string // Sent when an alarm is triggered
+	Recovery     string // Sent when an alarm is cleared
+	Status       string // Line of the value in the /status reply
 }
 
 type CommandConf struct {
-	Command     string
-	Topic       string
-	Message     string
-	FeedbackMsg string `mapstructure:"feedback_message"`
-	Help        string
+	Command        string
+	Topic          string
+	Message        string
+	FeedbackMsg    string `mapstructure:"feedback_message"`
+	Help           string
+	QoS            *byte `mapstructure:"qos"`
+	Retain         *bool
+	Label          string        // Name of the device in the confirmation reply, defaults to the command
+	StateTopic     string        `mapstructure:"state_topic"`     // Topic where the device reports its state
+	StatePayload   string        `mapstructure:"state_payload"`   // State confirming the command, defaults to Message
+	ConfirmTimeout time.Duration `mapstructure:"confirm_timeout"` // Defaults to DefaultConfirmTimeout
 }
 
 type IntentConf struct {
@@ -27,9 +101,211 @@ type IntentConf struct {
 	Room    string
 	Topic   string
 	Message string
+	QoS     *byte `mapstructure:"qos"`
+	Retain  *bool
 }
 
 type AlarmConf struct {
+	Name     string // Unique in the subscription, defaults to the operator
+	Severity string // info, warning (the default) or critical
+	Message  string // Template of the notification, overrides the alarm template
+	ChatID   int64  `mapstructure:"chat_id"` // Chat to notify instead of the default one
+	Operator string
+	Value    float64 // Threshold of the comparison operators, or change of rises_by and falls_by
+	Min      float64 // Range of between and outside
+	Max      float64
+	Text     string // Compared by equals, contains and matches (a regular expression)
+	// Hysteresis is how far the value must move back past the threshold to clear the alarm
+	Hysteresis float64
+	For        time.Duration // How long the condition must last to trigger the alarm
+	Window     time.Duration // Period of the change of rises_by and falls_by
+	// RepeatEvery makes the alarm sticky, notifying it again until acknowledged
+	RepeatEvery time.Duration `mapstructure:"repeat_every"`
+}
+
+// ConditionConf combines the current values of many topics, e.g. a window open while the heating
+// is on, triggering an alarm while it's true
+type ConditionConf struct {
+	Name        string // Unique, the condition state key is condition:<name>
+	Label       string // Defaults to the name
+	Severity    string
+	Message     string // Template of the alarm notification
+	ChatID      int64  `mapstructure:"chat_id"`
+	For         time.Duration
+	RepeatEvery time.Duration `mapstructure:"repeat_every"`
+	When        ExprConf
+}
+
+// ExprConf is a node of a condition: the and, or, not of other nodes, or the comparison of the
+// current value of a topic with one of the alarm operators
+type ExprConf struct {
+	And      []ExprConf
+	Or       []ExprConf
+	Not      *ExprConf
+	Topic    string // State key of the value, i.e. the topic followed by :<json_path> for JSON values
 	Operator string
 	Value    float64
+	Min      float64
+	Max      float64
+	Text     string
+}
+
+// ConditionKey returns the state key of the named condition
+func ConditionKey(name string) string {
+	return "condition:" + name
+}
+
+// Subscription returns the subscription whose values are the results of the condition, "true" or
+// "false", with an alarm active while it's true
+func (c ConditionConf) Subscription() SubscriptionConf {
+	label := c.Label
+	if label == "" {
+		label = c.Name
+	}
+	return SubscriptionConf{
+		Label:  label,
+		Topic:  ConditionKey(c.Name),
+		Values: map[string]string{"true": "active", "false": "inactive"},
+		Alarm: &AlarmConf{
+			Name:        c.Name,
+			Severity:    c.Severity,
+			Message:     c.Message,
+			ChatID:      c.ChatID,
+			Operator:    "equals",
+			Text:        "true",
+			For:         c.For,
+			RepeatEvery: c.RepeatEvery,
+		},
+	}
+}
+
+// RuleConf runs actions when a value is received, an alarm is triggered or at a time of the day,
+// e.g. switching on a light when motion is detected
+type RuleConf struct {
+	Name     string
+	Triggers []TriggerConf
+	When     *ExprConf // Optional, the rule runs only if true when triggered
+	Actions  []ActionConf
+	Cooldown time.Duration // Optional, minimum time between two runs
+	DryRun   bool          `mapstructure:"dry_run"` // Log the actions instead of running them
+}
+
+// TriggerConf starts a rule. It's either a value of a topic, compared with one of the alarm operators
+// if set, an alarm being triggered or a time of the day
+type TriggerConf struct {
+	Topic    string // State key of the value, like the topics of the conditions
+	Operator string
+	Value    float64
+	Min      float64
+	Max      float64
+	Text     string
+	Alarm    string // The alarm name, or <state key>#<name>
+	At       string // Time of the day, e.g. 07:30
+	Timezone string // IANA name of the time zone of At, the local time if empty
+}
+
+// ActionConf is a step of a rule: exactly one of publish, notify, delay and command
+type ActionConf struct {
+	Publish string // Topic to publish the message to
+	Message string
+	QoS     *byte `mapstructure:"qos"`
+	Retain  *bool
+	Notify  string // Template of the message sent to the bot
+	ChatID  int64  `mapstructure:"chat_id"`
+	Delay   time.Duration
+	Command string // Run one of the bot commands, without the slash
+}
+
+// Event is a value processed or an alarm triggered by the MQTT client
+type Event struct {
+	Key       string // State key
+	Value     string // Formatted value
+	Raw       string // Value received, compared by the string operators
+	Converted string // Value after scale and offset, compared by the numeric operators
+	Alarm     string // Name of the alarm triggered, empty for values
+}
+
+// AlarmID identifies the named alarm of a state key
+func AlarmID(key, name string) string {
+	return key + "#" + name
+}
+
+// LabelFor returns the label to show for a message received on the concrete topic. Wildcard
+// subscriptions append the topic to tell apart the devices sharing the same label
+func (s SubscriptionConf) LabelFor(topic string) string {
+	if s.Label == "" {
+		return topic
+	}
+	if IsWildcard(s.Topic) && topic != s.Topic {
+		return fmt.Sprintf("%s (%s)", s.Label, topic)
+	}
+	return s.Label
+}
+
+// AlarmConfs returns all the alarms of the subscription, with the defaults applied
+func (s SubscriptionConf) AlarmConfs() []AlarmConf {
+	var alarms []AlarmConf
+	if s.Alarm != nil {
+		alarms = append(alarms, *s.Alarm)
+	}
+	alarms = append(alarms, s.Alarms...)
+	for i := range alarms {
+		if alarms[i].Name == "" {
+			alarms[i].Name = alarms[i].Operator
+		}
+		if alarms[i].Severity == "" {
+			alarms[i].Severity = SeverityWarning
+		}
+	}
+	return alarms
+}
+
+// ValidQoS reports whether qos, if set, is a valid MQTT QoS level
+func ValidQoS(qos *byte) bool {
+	return qos == nil || *qos <= 2
+}
+
+// Value returns the value of the subscription carried by the payload, extracting it when a JSON
+// path is configured
+func (s SubscriptionConf) Value(payload []byte) ([]byte, error) {
+	if s.JSONPath == "" {
+		return payload, nil
+	}
+	return ExtractJSON(payload, s.JSONPath)
+}
+
+// StateKey identifies the state of the subscription for the concrete topic. Subscriptions reading
+// different JSON paths of the same topic have their own state
+func (s SubscriptionConf) StateKey(topic string) string {
+	if s.JSONPath == "" {
+		return topic
+	}
+	return fmt.Sprintf("%s:%s", topic, s.JSONPath)
+}
+
+// Confirmation returns the state confirming the command, or nil if the command doesn't wait for it
+func (c CommandConf) Confirmation() *Confirmation {
+	if c.StateTopic == "" {
+		return nil
+	}
+	conf := &Confirmation{
+		Topic:   c.StateTopic,
+		Payload: c.StatePayload,
+		Timeout: c.ConfirmTimeout,
+	}
+	if conf.Payload == "" {
+		conf.Payload = c.Message
+	}
+	if conf.Timeout == 0 {
+		conf.Timeout = DefaultConfirmTimeout
+	}
+	return conf
+}
+
+// DeviceLabel returns the name of the device the command acts on
+func (c CommandConf) DeviceLabel() string {
+	if c.Label == "" {
+		return c.Command
+	}
+	return c.Label
 }
@@ -0,0 +1,105 @@
+package her
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ExtractJSON returns the value found at path in the JSON payload. The path is a dot separated
+// list of object keys, each optionally followed by array indexes, like "state.power[0]".
+// Strings are returned unquoted, numbers as sent by the device and objects or arrays as JSON
+func ExtractJSON(payload []byte, path string) ([]byte, error) {
+	steps, err := parseJSONPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	d := json.NewDecoder(bytes.NewReader(payload))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, fmt.Errorf("invalid JSON payload: %w", err)
+	}
+
+	for _, step := range steps {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			if step.key == "" {
+				return nil, fmt.Errorf("cannot index an object in %s", path)
+			}
+			child, ok := node[step.key]
+			if !ok {
+				return nil, fmt.Errorf("key %s not found in %s", step.key, path)
+			}
+			v = child
+		case []interface{}:
+			if step.key != "" {
+				return nil, fmt.Errorf("cannot get key %s of an array in %s", step.key, path)
+			}
+			if step.index >= len(node) {
+				return nil, fmt.Errorf("index %d out of range in %s", step.index, path)
+			}
+			v = node[step.index]
+		default:
+			return nil, fmt.Errorf("cannot traverse a scalar value in %s", path)
+		}
+	}
+
+	switch value := v.(type) {
+	case string:
+		return []byte(value), nil
+	case json.Number:
+		return []byte(value.String()), nil
+	case bool:
+		return []byte(strconv.FormatBool(value)), nil
+	case nil:
+		return nil, fmt.Errorf("null value at %s", path)
+	default:
+		return json.Marshal(value)
+	}
+}
+
+// jsonPathStep is either an object key or, when key is empty, an array index
+type jsonPathStep struct {
+	key   string
+	index int
+}
+
+func parseJSONPath(path string) ([]jsonPathStep, error) {
+	if path == "" {
+		return nil, fmt.Errorf("empty JSON path")
+	}
+
+	var steps []jsonPathStep
+	for _, part := range strings.Split(path, ".") {
+		key := part
+		indexes := ""
+		if i := strings.Index(part, "["); i >= 0 {
+			key, indexes = part[:i], part[i:]
+		}
+		if key == "" && indexes == "" {
+			return nil, fmt.Errorf("empty key in JSON path %s", path)
+		}
+		if key != "" {
+			steps = append(steps, jsonPathStep{key: key})
+		}
+
+		for indexes != "" {
+			end := strings.Index(indexes, "]")
+			if indexes[0] != '[' || end < 0 {
+				return nil, fmt.Errorf("invalid index in JSON path %s", path)
+			}
+			index, err := strconv.Atoi(indexes[1:end])
+			if err != nil || index < 0 {
+				return nil, fmt.Errorf("invalid index in JSON path %s", path)
+			}
+			steps = append(steps, jsonPathStep{index: index})
+			indexes = indexes[end+1:]
+		}
+	}
+
+	return steps, nil
+}
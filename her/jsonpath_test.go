@@ -0,0 +1,55 @@
+package her
+
+import "testing"
+
+func TestExtractJSON(t *testing.T) {
+	payload := []byte(`{"temperature": 21.50, "state": {"power": [12, 3.4], "name": "kitchen", "on": true, "nothing": null}}`)
+
+	tests := []struct {
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{"temperature", "21.50", false},
+		{"state.power[0]", "12", false},
+		{"state.power[1]", "3.4", false},
+		{"state.name", "kitchen", false},
+		{"state.on", "true", false},
+		{"state.power", "[12,3.4]", false},
+		{"state.nothing", "", true},
+		{"state.power[2]", "", true},
+		{"humidity", "", true},
+		{"temperature.value", "", true},
+		{"state..name", "", true},
+		{"state.power[x]", "", true},
+		{"", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			got, err := ExtractJSON(payload, tt.path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ExtractJSON() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if string(got) != tt.want {
+				t.Errorf("ExtractJSON() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("Invalid payload", func(t *testing.T) {
+		if _, err := ExtractJSON([]byte("21.5"), "temperature"); err == nil {
+			t.Errorf("Expected error")
+		}
+		if _, err := ExtractJSON([]byte("{"), "temperature"); err == nil {
+			t.Errorf("Expected error")
+		}
+	})
+
+	t.Run("Array root", func(t *testing.T) {
+		got, err := ExtractJSON([]byte(`[{"v": 1}]`), "[0].v")
+		if err != nil || string(got) != "1" {
+			t.Errorf("ExtractJSON() = %s, %v", got, err)
+		}
+	})
+}
@@ -0,0 +1,21 @@
+package her
+
+// Alarm severities, from the least to the most serious
+const (
+	SeverityInfo     = "info"
+	SeverityWarning  = "warning"
+	SeverityCritical = "critical"
+)
+
+// SeverityRank orders the severities, returning -1 for unknown ones
+func SeverityRank(severity string) int {
+	switch severity {
+	case SeverityInfo:
+		return 0
+	case SeverityWarning:
+		return 1
+	case SeverityCritical:
+		return 2
+	}
+	return -1
+}
@@ -0,0 +1,38 @@
+package her
+
+import "strings"
+
+// TopicMatches reports whether the concrete topic matches the subscription filter, following the
+// MQTT rules for the single level (+) and multi level (#) wildcards
+func TopicMatches(filter, topic string) bool {
+	if filter == topic {
+		return true
+	}
+
+	// Topics beginning with $ are reserved to the broker and never match a leading wildcard
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+
+	for i, f := range filterLevels {
+		if f == "#" {
+			return i == len(filterLevels)-1
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if f != "+" && f != topicLevels[i] {
+			return false
+		}
+	}
+
+	return len(filterLevels) == len(topicLevels)
+}
+
+// IsWildcard reports whether the topic filter contains MQTT wildcards
+func IsWildcard(filter string) bool {
+	return strings.ContainsAny(filter, "+#")
+}
@@ -0,0 +1,56 @@
+package her
+
+import "testing"
+
+func TestTopicMatches(t *testing.T) {
+	tests := []struct {
+		filter string
+		topic  string
+		want   bool
+	}{
+		{"sensor/temperature", "sensor/temperature", true},
+		{"sensor/temperature", "sensor/humidity", false},
+		{"zigbee2mqtt/+/temperature", "zigbee2mqtt/kitchen/temperature", true},
+		{"zigbee2mqtt/+/temperature", "zigbee2mqtt/kitchen/humidity", false},
+		{"zigbee2mqtt/+/temperature", "zigbee2mqtt/kitchen/sensor/temperature", false},
+		{"zigbee2mqtt/+", "zigbee2mqtt", false},
+		{"zigbee2mqtt/#", "zigbee2mqtt", true},
+		{"zigbee2mqtt/#", "zigbee2mqtt/kitchen/temperature", true},
+		{"zigbee2mqtt/#", "tasmota/kitchen", false},
+		{"#", "any/topic", true},
+		{"+/+", "a/b", true},
+		{"+/+", "a/b/c", false},
+		{"#", "$SYS/broker/uptime", false},
+		{"+/broker/uptime", "$SYS/broker/uptime", false},
+		{"$SYS/#", "$SYS/broker/uptime", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.filter+" "+tt.topic, func(t *testing.T) {
+			if got := TopicMatches(tt.filter, tt.topic); got != tt.want {
+				t.Errorf("TopicMatches(%q, %q) = %v, want %v", tt.filter, tt.topic, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLabelFor(t *testing.T) {
+	tests := []struct {
+		name  string
+		s     SubscriptionConf
+		topic string
+		want  string
+	}{
+		{"Plain label", SubscriptionConf{Label: "Kitchen", Topic: "sensor/kitchen"}, "sensor/kitchen", "Kitchen"},
+		{"Missing label", SubscriptionConf{Topic: "sensor/kitchen"}, "sensor/kitchen", "sensor/kitchen"},
+		{"Wildcard label", SubscriptionConf{Label: "Temperature", Topic: "sensor/+"}, "sensor/kitchen", "Temperature (sensor/kitchen)"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.s.LabelFor(tt.topic); got != tt.want {
+				t.Errorf("LabelFor() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
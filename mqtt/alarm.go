@@ -0,0 +1,362 @@
+package mqtt
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tommyblue/her/alarm"
+	"github.com/tommyblue/her/her"
+	"github.com/tommyblue/her/notify"
+	"github.com/tommyblue/her/state"
+)
+
+// pendingAlarm is an alarm whose condition is true, waiting for its duration to elapse
+type pendingAlarm struct {
+	timer        *time.Timer
+	subscription her.SubscriptionConf
+	alarm        her.AlarmConf
+	data         notify.Data // Updated with the latest value
+}
+
+// outbox collects the events and the notifications of the alarms while alarmMu is held, to send
+// them once it's released: the observers and the delivery to the bot may block
+type outbox struct {
+	events   []her.Event
+	messages []outgoing
+}
+
+// outgoing is a notification waiting in the outbox
+type outgoing struct {
+	subscription her.SubscriptionConf
+	data         notify.Data
+	msg          her.Message
+	severity     string
+}
+
+// flush emits the events and delivers the notifications of the outbox. It must be called
+// without holding alarmMu
+func (c *Client) flush(out *outbox) {
+	for _, event := range out.events {
+		c.emit(event)
+	}
+	for _, o := range out.messages {
+		c.deliver(o.subscription, o.data, o.msg, o.severity, false)
+	}
+}
+
+// checkAlarms evaluates all the alarms of the subscription. The numeric values are recorded first,
+// as long as the longest window of the rate alarms, which compare the value with the previous ones
+func (c *Client) checkAlarms(s her.SubscriptionConf, data notify.Data, value []byte) {
+	var window time.Duration
+	for _, a := range s.AlarmConfs() {
+		if alarm.RateOperator(a.Operator) && a.Window > window {
+			window = a.Window
+		}
+	}
+	if window > 0 {
+		if v, err := strconv.ParseFloat(string(value), 64); err == nil {
+			c.store.Record(data.Key, v, data.Timestamp, window)
+		}
+	}
+
+	for _, a := range s.AlarmConfs() {
+		if err := c.checkAlarm(s, a, data, value); err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+// checkAlarm evaluates the alarm, notifying only when it's triggered or cleared. Numeric operators
+// use the value after scale and offset but not rounded, string operators the raw value. Alarms with
+// a duration are triggered by a timer, if the condition is still true when it expires
+func (c *Client) checkAlarm(s her.SubscriptionConf, a her.AlarmConf, data notify.Data, value []byte) error {
+	condition, err := c.alarmFor(a)
+	if err != nil {
+		return fmt.Errorf("subscription %s: %w", s.Topic, err)
+	}
+
+	var out outbox
+	defer c.flush(&out)
+	c.alarmMu.Lock()
+	defer c.alarmMu.Unlock()
+
+	entry, _ := c.store.Get(data.Key)
+	current := entry.Alarms[a.Name]
+	data.Alarm = alarmDetails(a, current)
+
+	var active bool
+	if condition.Window() > 0 {
+		var v float64
+		if v, err = strconv.ParseFloat(string(value), 64); err == nil {
+			data.Alarm.Value = v
+			data.Alarm.Change = alarm.Change(a.Operator, v, c.store.History(data.Key, data.Timestamp.Add(-condition.Window())))
+			active, err = condition.Evaluate(strconv.FormatFloat(data.Alarm.Change, 'f', -1, 64), current.Active)
+		} else {
+			err = fmt.Errorf("cannot convert to a number the value %s", value)
+		}
+	} else if condition.Numeric() {
+		active, err = condition.Evaluate(string(value), current.Active)
+		if err == nil {
+			data.Alarm.Value, _ = strconv.ParseFloat(string(value), 64)
+		}
+	} else {
+		active, err = condition.Evaluate(data.Raw, current.Active)
+	}
+	if err != nil {
+		return fmt.Errorf("alarm %s of %s: %w", a.Name, data.Label, err)
+	}
+
+	switch {
+	case active && !current.Active && a.For > 0:
+		c.deferAlarm(s, a, data)
+		return nil
+	case !active:
+		c.cancelAlarm(data.Key, a.Name)
+	}
+
+	if active == current.Active {
+		// Sticky alarms loaded from the saved state are repeated as soon as they're confirmed
+		if active && a.RepeatEvery > 0 && !current.Acked() {
+			c.repeatAlarm(s, a, data)
+		}
+		return nil
+	}
+	if active {
+		return c.triggerAlarm(&out, s, a, data)
+	}
+	return c.clearAlarm(&out, s, a, data)
+}
+
+// deferAlarm starts the timer of the alarm, or updates its value if already started. It must be
+// called holding alarmMu
+func (c *Client) deferAlarm(s her.SubscriptionConf, a her.AlarmConf, data notify.Data) {
+	key := her.AlarmID(data.Key, a.Name)
+	if p, ok := c.pending[key]; ok {
+		p.data = data
+		return
+	}
+
+	log.Infof("Alarm %s of %s pending for %s", a.Name, data.Label, a.For)
+	p := &pendingAlarm{subscription: s, alarm: a, data: data}
+	p.timer = time.AfterFunc(a.For, func() {
+		var out outbox
+		defer c.flush(&out)
+		c.alarmMu.Lock()
+		defer c.alarmMu.Unlock()
+
+		if c.pending[key] != p {
+			return
+		}
+		delete(c.pending, key)
+		if err := c.triggerAlarm(&out, p.subscription, p.alarm, p.data); err != nil {
+			log.Error(err)
+		}
+		// The status line was formatted when the value was received, before the alarm
+		if templates, err := c.templatesFor(p.subscription); err == nil {
+			c.updateStatusLine(p.subscription, templates, p.data)
+		}
+	})
+	if c.pending == nil {
+		c.pending = make(map[string]*pendingAlarm)
+	}
+	c.pending[key] = p
+}
+
+// cancelAlarm stops the timer of the alarm, if any. It must be called holding alarmMu
+func (c *Client) cancelAlarm(key, name string) {
+	if p, ok := c.pending[her.AlarmID(key, name)]; ok {
+		log.Infof("Alarm %s of %s cancelled", name, p.data.Label)
+		p.timer.Stop()
+		delete(c.pending, her.AlarmID(key, name))
+	}
+}
+
+// cancelAlarms stops all the timers, at shutdown
+func (c *Client) cancelAlarms() {
+	c.alarmMu.Lock()
+	defer c.alarmMu.Unlock()
+
+	for key, p := range c.pending {
+		p.timer.Stop()
+		delete(c.pending, key)
+	}
+	for key, r := range c.repeating {
+		r.timer.Stop()
+		delete(c.repeating, key)
+	}
+}
+
+// repeatAlarm notifies the sticky alarm again every RepeatEvery, until it's acknowledged or
+// cleared. It must be called holding alarmMu
+func (c *Client) repeatAlarm(s her.SubscriptionConf, a her.AlarmConf, data notify.Data) {
+	id := her.AlarmID(data.Key, a.Name)
+	if _, ok := c.repeating[id]; ok {
+		return
+	}
+
+	r := &pendingAlarm{subscription: s, alarm: a, data: data}
+	var repeat func()
+	repeat = func() {
+		var out outbox
+		defer c.flush(&out)
+		c.alarmMu.Lock()
+		defer c.alarmMu.Unlock()
+
+		if c.repeating[id] != r {
+			return
+		}
+		entry, _ := c.store.Get(data.Key)
+		current := entry.Alarms[a.Name]
+		if !current.Active || current.Acked() {
+			delete(c.repeating, id)
+			return
+		}
+
+		r.data.Alarm.Repeat++
+		if err := c.notifyAlarm(&out, r.subscription, r.alarm, r.data); err != nil {
+			log.Error(err)
+		}
+		r.timer = time.AfterFunc(a.RepeatEvery, repeat)
+	}
+	r.timer = time.AfterFunc(a.RepeatEvery, repeat)
+	if c.repeating == nil {
+		c.repeating = make(map[string]*pendingAlarm)
+	}
+	c.repeating[id] = r
+}
+
+// stopRepeating stops the notifications of the sticky alarm. It must be called holding alarmMu
+func (c *Client) stopRepeating(key, name string) {
+	id := her.AlarmID(key, name)
+	if r, ok := c.repeating[id]; ok {
+		r.timer.Stop()
+		delete(c.repeating, id)
+	}
+}
+
+// triggerAlarm activates the alarm and queues its notification in the outbox. It must be called
+// holding alarmMu
+func (c *Client) triggerAlarm(out *outbox, s her.SubscriptionConf, a her.AlarmConf, data notify.Data) error {
+	now := time.Now()
+	entry, _ := c.store.Get(data.Key)
+	current := entry.Alarms[a.Name]
+	current.Active = true
+	current.Severity = a.Severity
+	current.Value = data.Value
+	current.TriggeredAt = now
+	current.AckedBy = ""
+	current.AckedAt = time.Time{}
+	c.store.SetAlarm(data.Key, a.Name, current)
+	out.events = append(out.events, her.Event{Key: data.Key, Value: data.Value, Alarm: a.Name})
+
+	data.Alarm.Active = true
+	data.Alarm.TriggeredAt = now
+	if a.RepeatEvery > 0 {
+		c.repeatAlarm(s, a, data)
+	}
+	return c.notifyAlarm(out, s, a, data)
+}
+
+// notifyAlarm queues the alarm notification in the outbox. Sticky alarms can be acknowledged from it
+func (c *Client) notifyAlarm(out *outbox, s her.SubscriptionConf, a her.AlarmConf, data notify.Data) error {
+	templates, err := c.alarmTemplatesFor(s, a)
+	if err != nil {
+		return err
+	}
+	text, err := templates.Alarm(data)
+	if err != nil {
+		return err
+	}
+	msg := her.Message{
+		Topic:   data.Key,
+		Message: []byte(text),
+		Text:    text,
+		ChatID:  a.ChatID,
+	}
+	if a.RepeatEvery > 0 {
+		msg.AlarmID = her.AlarmID(data.Key, a.Name)
+	}
+	out.messages = append(out.messages, outgoing{subscription: s, data: data, msg: msg, severity: a.Severity})
+	return nil
+}
+
+// clearAlarm deactivates the alarm and queues the recovery notification in the outbox. It must be
+// called holding alarmMu
+func (c *Client) clearAlarm(out *outbox, s her.SubscriptionConf, a her.AlarmConf, data notify.Data) error {
+	entry, _ := c.store.Get(data.Key)
+	current := entry.Alarms[a.Name]
+	current.Active = false
+	current.ClearedAt = data.Timestamp
+	c.store.SetAlarm(data.Key, a.Name, current)
+	c.stopRepeating(data.Key, a.Name)
+
+	data.Alarm.Active = false
+	templates, err := c.alarmTemplatesFor(s, a)
+	if err != nil {
+		return err
+	}
+	text, err := templates.Recovery(data)
+	if err != nil {
+		return err
+	}
+	msg := her.Message{Topic: data.Key, Message: []byte(text), Text: text, ChatID: a.ChatID}
+	out.messages = append(out.messages, outgoing{subscription: s, data: data, msg: msg, severity: a.Severity})
+	return nil
+}
+
+// alarmDetails describes the alarm to the templates
+func alarmDetails(a her.AlarmConf, current state.Alarm) notify.Alarm {
+	return notify.Alarm{
+		Name:        a.Name,
+		Severity:    a.Severity,
+		Active:      current.Active,
+		Operator:    a.Operator,
+		Threshold:   a.Value,
+		Min:         a.Min,
+		Max:         a.Max,
+		Text:        a.Text,
+		For:         a.For,
+		Window:      a.Window,
+		TriggeredAt: current.TriggeredAt,
+	}
+}
+
+// worstAlarm returns the most severe active alarm of the entry or, if none is active, the first
+func worstAlarm(alarms []her.AlarmConf, entry state.Entry) notify.Alarm {
+	if len(alarms) == 0 {
+		return notify.Alarm{}
+	}
+	worst := alarms[0]
+	active := false
+	for _, a := range alarms {
+		if !entry.Alarms[a.Name].Active {
+			continue
+		}
+		if !active || her.SeverityRank(a.Severity) > her.SeverityRank(worst.Severity) {
+			worst = a
+			active = true
+		}
+	}
+	return alarmDetails(worst, entry.Alarms[worst.Name])
+}
+
+// alarmFor returns the alarm condition, compiling it the first time
+func (c *Client) alarmFor(a her.AlarmConf) (*alarm.Condition, error) {
+	c.cacheMu.Lock()
+	defer c.cacheMu.Unlock()
+
+	if condition, ok := c.alarmCache[a]; ok {
+		return condition, nil
+	}
+	condition, err := alarm.Compile(a)
+	if err != nil {
+		return nil, err
+	}
+	if c.alarmCache == nil {
+		c.alarmCache = make(map[her.AlarmConf]*alarm.Condition)
+	}
+	c.alarmCache[a] = condition
+	return condition, nil
+}
@@ -0,0 +1,309 @@
+package mqtt
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/tommyblue/her/her"
+	"github.com/tommyblue/her/state"
+)
+
+func TestAlarmDuration(t *testing.T) {
+	outCh := make(chan her.Message, 10)
+	client := &Client{
+		outCh: outCh,
+		store: state.NewStore(),
+		subscriptions: []her.SubscriptionConf{{
+			Label: "Freezer",
+			Topic: "freezer/temperature",
+			Alarm: &her.AlarmConf{Operator: "greater_than", Value: -10, For: 50 * time.Millisecond},
+		}},
+	}
+	send := func(v string) {
+		client.msgCallback(nil, mqttMessageMock{topic: "freezer/temperature", payload: []byte(v)})
+	}
+
+	// Cleared before the duration: never notified
+	send("-8")
+	send("-12")
+	time.Sleep(100 * time.Millisecond)
+	if len(outCh) != 0 {
+		t.Fatalf("Unexpected message %s", (<-outCh).Text)
+	}
+
+	// Lasting: notified by the timer with the latest value
+	send("-9")
+	send("-7")
+	if len(outCh) != 0 {
+		t.Fatal("The alarm must wait for its duration")
+	}
+	select {
+	case msg := <-outCh:
+		if want := "[freezer/temperature] Alarm: Freezer value is -7"; msg.Text != want {
+			t.Errorf("got %q, want %q", msg.Text, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Alarm not triggered")
+	}
+	if e, _ := client.store.Get("freezer/temperature"); !e.Alarms["greater_than"].Active || e.Alarms["greater_than"].Value != "-7" {
+		t.Errorf("unexpected alarm state %+v", e.Alarms)
+	}
+
+	// The recovery is immediate
+	send("-15")
+	if msg := <-outCh; msg.Text != "[freezer/temperature] Back to normal: Freezer value is -15" {
+		t.Errorf("unexpected message %q", msg.Text)
+	}
+}
+
+func TestAlarmFormattedValue(t *testing.T) {
+	precision := 0
+	outCh := make(chan her.Message, 10)
+	client := &Client{
+		outCh: outCh,
+		store: state.NewStore(),
+		subscriptions: []her.SubscriptionConf{
+			{
+				Label:     "Living room",
+				Topic:     "living/temperature",
+				Unit:      "°C",
+				Precision: &precision,
+				Alarm:     &her.AlarmConf{Operator: "greater_than", Value: 21},
+			},
+			{
+				Label:  "Window",
+				Topic:  "living/window",
+				Values: map[string]string{"1": "open", "0": "closed"},
+				Alarm:  &her.AlarmConf{Operator: "equal_to", Value: 1},
+			},
+		},
+	}
+	client.msgCallback(nil, mqttMessageMock{topic: "living/temperature", payload: []byte("21.4")})
+	client.msgCallback(nil, mqttMessageMock{topic: "living/window", payload: []byte("1")})
+	close(outCh)
+
+	want := []string{
+		"[living/temperature] Alarm: Living room value is 21 °C",
+		"[living/window] Alarm: Window value is open",
+	}
+	var got []string
+	for msg := range outCh {
+		got = append(got, msg.Text)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestCancelAlarms(t *testing.T) {
+	client := &Client{
+		outCh: make(chan her.Message, 1),
+		store: state.NewStore(),
+		subscriptions: []her.SubscriptionConf{{
+			Topic: "garage/door",
+			Alarm: &her.AlarmConf{Operator: "equals", Text: "OPEN", For: 20 * time.Millisecond},
+		}},
+	}
+	client.msgCallback(nil, mqttMessageMock{topic: "garage/door", payload: []byte("OPEN")})
+	client.cancelAlarms()
+	time.Sleep(50 * time.Millisecond)
+	if len(client.outCh) != 0 || len(client.pending) != 0 {
+		t.Errorf("unexpected alarm, pending: %v", client.pending)
+	}
+}
+
+func TestAlarmDeliveryUnlocked(t *testing.T) {
+	// Nobody reads the notifications: the delivery blocks
+	outCh := make(chan her.Message)
+	client := &Client{
+		outCh: outCh,
+		store: state.NewStore(),
+		subscriptions: []her.SubscriptionConf{{
+			Topic: "garage/door",
+			Alarm: &her.AlarmConf{Operator: "equals", Text: "OPEN"},
+		}},
+	}
+	go client.msgCallback(nil, mqttMessageMock{topic: "garage/door", payload: []byte("OPEN")})
+	for {
+		if e, _ := client.store.Get("garage/door"); e.Alarms["equals"].Active {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// The alarms aren't locked while waiting
+	done := make(chan struct{})
+	go func() {
+		client.cancelAlarms()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("alarmMu held while delivering the notification")
+	}
+	if msg := <-outCh; msg.Text != "[garage/door] Alarm: garage/door value is OPEN" {
+		t.Errorf("unexpected message %q", msg.Text)
+	}
+}
+
+func TestMultipleAlarms(t *testing.T) {
+	outCh := make(chan her.Message, 10)
+	client := &Client{
+		outCh: outCh,
+		store: state.NewStore(),
+		subscriptions: []her.SubscriptionConf{{
+			Label: "Temperature",
+			Topic: "sensor/temperature",
+			Alarms: []her.AlarmConf{
+				{Name: "warm", Operator: "greater_than", Value: 25},
+				{
+					Name:     "hot",
+					Severity: her.SeverityCritical,
+					Operator: "greater_than",
+					Value:    30,
+					Message:  "🔥 {{.Label}} is {{.Value}} ({{.Alarm.Severity}})",
+					ChatID:   42,
+				},
+			},
+		}},
+	}
+	send := func(v string) {
+		client.msgCallback(nil, mqttMessageMock{topic: "sensor/temperature", payload: []byte(v)})
+	}
+
+	send("26")
+	send("31")
+	e, _ := client.store.Get("sensor/temperature")
+	if e.Severity() != her.SeverityCritical || e.StatusLine != "Temperature: 31 (critical)" {
+		t.Errorf("unexpected entry %+v", e)
+	}
+	send("27")
+	e, _ = client.store.Get("sensor/temperature")
+	if e.StatusLine != "Temperature: 27 (warning)" {
+		t.Errorf("unexpected status line %q", e.StatusLine)
+	}
+	close(outCh)
+
+	want := []string{
+		"0 [sensor/temperature] Alarm: Temperature value is 26",
+		"42 🔥 Temperature is 31 (critical)",
+		"42 [sensor/temperature] Back to normal: Temperature value is 27",
+	}
+	var got []string
+	for msg := range outCh {
+		got = append(got, fmt.Sprintf("%d %s", msg.ChatID, msg.Text))
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestStickyAlarm(t *testing.T) {
+	outCh := make(chan her.Message, 10)
+	client := &Client{
+		outCh: outCh,
+		store: state.NewStore(),
+		subscriptions: []her.SubscriptionConf{{
+			Label: "Bathroom",
+			Topic: "bathroom/leak",
+			Alarm: &her.AlarmConf{Name: "leak", Operator: "equals", Text: "wet", RepeatEvery: 30 * time.Millisecond},
+		}},
+	}
+	client.msgCallback(nil, mqttMessageMock{topic: "bathroom/leak", payload: []byte("wet")})
+	if msg := <-outCh; msg.AlarmID != "bathroom/leak#leak" || msg.Text != "[bathroom/leak] Alarm: Bathroom value is wet" {
+		t.Errorf("unexpected message %+v", msg)
+	}
+
+	// Repeated until acknowledged
+	select {
+	case msg := <-outCh:
+		if want := "[bathroom/leak] Reminder, alarm: Bathroom value is wet"; msg.Text != want {
+			t.Errorf("got %q, want %q", msg.Text, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Alarm not repeated")
+	}
+	client.store.Ack("bathroom/leak", "leak", "tommy", time.Now())
+	time.Sleep(100 * time.Millisecond)
+	for len(outCh) > 0 {
+		// A reminder may have been sent before the acknowledgement
+		<-outCh
+	}
+	time.Sleep(100 * time.Millisecond)
+	if len(outCh) != 0 {
+		t.Errorf("Acknowledged alarm repeated: %q", (<-outCh).Text)
+	}
+
+	// A new alarm must be acknowledged again
+	client.msgCallback(nil, mqttMessageMock{topic: "bathroom/leak", payload: []byte("dry")})
+	client.msgCallback(nil, mqttMessageMock{topic: "bathroom/leak", payload: []byte("wet")})
+	if e, _ := client.store.Get("bathroom/leak"); e.Alarms["leak"].Acked() {
+		t.Errorf("unexpected acknowledgement %+v", e.Alarms["leak"])
+	}
+	client.cancelAlarms()
+	if len(client.repeating) != 0 {
+		t.Errorf("Repeating alarms not cancelled: %v", client.repeating)
+	}
+}
+
+func TestRateAlarm(t *testing.T) {
+	outCh := make(chan her.Message, 10)
+	client := &Client{
+		outCh: outCh,
+		store: state.NewStore(),
+		subscriptions: []her.SubscriptionConf{{
+			Label: "Kitchen",
+			Topic: "kitchen/temperature",
+			Alarm: &her.AlarmConf{Operator: "rises_by", Value: 5, Window: time.Hour},
+		}},
+	}
+	for _, v := range []string{"20", "18", "21", "22.5"} {
+		client.msgCallback(nil, mqttMessageMock{topic: "kitchen/temperature", payload: []byte(v)})
+	}
+	if len(outCh) != 0 {
+		t.Fatalf("Unexpected message %q", (<-outCh).Text)
+	}
+
+	// Compared with the lowest value in the window, not just the previous one
+	client.msgCallback(nil, mqttMessageMock{topic: "kitchen/temperature", payload: []byte("23")})
+	if msg := <-outCh; msg.Text != "[kitchen/temperature] Alarm: Kitchen value is 23 (+5.00 in 1h0m0s)" {
+		t.Errorf("unexpected message %q", msg.Text)
+	}
+	if e, _ := client.store.Get("kitchen/temperature"); !e.Alarms["rises_by"].Active {
+		t.Errorf("unexpected alarm state %+v", e.Alarms)
+	}
+}
+
+func TestMutedAlarm(t *testing.T) {
+	outCh := make(chan her.Message, 10)
+	client := &Client{
+		outCh: outCh,
+		store: state.NewStore(),
+		subscriptions: []her.SubscriptionConf{{
+			Label:  "Kitchen",
+			Topic:  "kitchen/temperature",
+			Repeat: true,
+			Alarm:  &her.AlarmConf{Operator: "greater_than", Value: 25},
+		}},
+	}
+	client.store.Mute(state.Mute{Target: "kitchen", Until: time.Now().Add(time.Hour)})
+	client.msgCallback(nil, mqttMessageMock{topic: "kitchen/temperature", payload: []byte("30")})
+	if len(outCh) != 0 {
+		t.Fatalf("Unexpected message %q", (<-outCh).Text)
+	}
+	// The alarm state is still tracked
+	if e, _ := client.store.Get("kitchen/temperature"); !e.Alarms["greater_than"].Active {
+		t.Errorf("unexpected alarm state %+v", e.Alarms)
+	}
+
+	client.store.Unmute("")
+	client.msgCallback(nil, mqttMessageMock{topic: "kitchen/temperature", payload: []byte("20")})
+	if msg := <-outCh; msg.Text != "[kitchen/temperature] 20" {
+		t.Errorf("unexpected message %q", msg.Text)
+	}
+	if msg := <-outCh; msg.Text != "[kitchen/temperature] Back to normal: Kitchen value is 20" {
+		t.Errorf("unexpected message %q", msg.Text)
+	}
+}
@@ -0,0 +1,75 @@
+package mqtt
+
+import (
+	"fmt"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tommyblue/her/alarm"
+	"github.com/tommyblue/her/her"
+)
+
+// condition is a composite condition, evaluated whenever one of its topics changes
+type condition struct {
+	expr         *alarm.Expr
+	subscription her.SubscriptionConf // Receives the results of the condition
+}
+
+// AddCondition evaluates the condition whenever the value of one of its topics changes, with an
+// alarm active while it's true
+func (c *Client) AddCondition(conf her.ConditionConf) error {
+	expr, err := alarm.CompileCondition(conf)
+	if err != nil {
+		return err
+	}
+	s := conf.Subscription()
+	if _, err := c.alarmTemplatesFor(s, s.AlarmConfs()[0]); err != nil {
+		return err
+	}
+
+	c.subsMu.Lock()
+	defer c.subsMu.Unlock()
+
+	for _, other := range c.conditions {
+		if other.subscription.Topic == s.Topic {
+			return fmt.Errorf("condition %s already exists", conf.Name)
+		}
+	}
+	log.Info("Adding condition ", conf.Name)
+	c.conditions = append(c.conditions, condition{expr: expr, subscription: s})
+	return nil
+}
+
+// checkConditions evaluates the conditions depending on the key. Their results are processed like
+// the values of a subscription when they change, so conditions have alarms, templates and mutes
+func (c *Client) checkConditions(key string) {
+	var conditions []condition
+	c.subsMu.RLock()
+	for _, cond := range c.conditions {
+		for _, topic := range cond.expr.Topics() {
+			if topic == key {
+				conditions = append(conditions, cond)
+				break
+			}
+		}
+	}
+	c.subsMu.RUnlock()
+
+	for _, cond := range conditions {
+		result, err := cond.expr.Evaluate(func(topic string) (alarm.Value, bool) {
+			e, ok := c.store.Get(topic)
+			return alarm.Value{Raw: e.Raw, Converted: e.Converted}, ok
+		})
+		if err != nil {
+			log.Debugf("Cannot evaluate %s: %v", cond.subscription.Label, err)
+			continue
+		}
+
+		value := []byte(strconv.FormatBool(result))
+		key := cond.subscription.Topic
+		if e, ok := c.store.Get(key); ok && !e.Stale() && e.Value == cond.subscription.Display(value) {
+			continue
+		}
+		c.processValue(cond.subscription, key, value)
+	}
+}
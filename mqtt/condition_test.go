@@ -0,0 +1,74 @@
+package mqtt
+
+import (
+	"testing"
+
+	"github.com/tommyblue/her/her"
+	"github.com/tommyblue/her/state"
+)
+
+func TestConditions(t *testing.T) {
+	outCh := make(chan her.Message, 10)
+	precision := 0
+	client := &Client{
+		outCh: outCh,
+		store: state.NewStore(),
+		subscriptions: []her.SubscriptionConf{
+			{Label: "Window", Topic: "window", Values: map[string]string{"ON": "open", "OFF": "closed"}},
+			{Label: "Heating", Topic: "heating"},
+			{Label: "Temperature", Topic: "temperature", Precision: &precision},
+		},
+	}
+	conf := her.ConditionConf{
+		Name:  "heating_window",
+		Label: "Heating with the window open",
+		// Like the alarms, conditions compare the values received, not the displayed ones
+		When: her.ExprConf{And: []her.ExprConf{
+			{Topic: "window", Operator: "equals", Text: "ON"},
+			{Topic: "heating", Operator: "equals", Text: "ON"},
+			{Topic: "temperature", Operator: "less_than", Value: 21.2},
+		}},
+	}
+	if err := client.AddCondition(conf); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.AddCondition(conf); err == nil {
+		t.Error("Expected error for a duplicated condition")
+	}
+	send := func(topic, v string) {
+		client.msgCallback(nil, mqttMessageMock{topic: topic, payload: []byte(v)})
+	}
+
+	// Not evaluated until every topic has a value
+	send("window", "ON")
+	if _, ok := client.store.Get("condition:heating_window"); ok {
+		t.Error("Condition evaluated without all the values")
+	}
+
+	send("heating", "ON")
+	send("temperature", "21.3") // Shown as 21
+	if len(outCh) != 0 {
+		t.Fatalf("Unexpected message %q", (<-outCh).Text)
+	}
+
+	send("temperature", "21.1")
+	if msg := <-outCh; msg.Text != "[condition:heating_window] Alarm: Heating with the window open value is active" {
+		t.Errorf("unexpected message %q", msg.Text)
+	}
+	e, _ := client.store.Get("condition:heating_window")
+	if e.Value != "active" || !e.Alarms["heating_window"].Active {
+		t.Errorf("unexpected entry %+v", e)
+	}
+
+	// Unchanged results are not processed again
+	send("heating", "ON")
+	send("temperature", "21")
+	if len(outCh) != 0 {
+		t.Fatalf("Unexpected message %q", (<-outCh).Text)
+	}
+
+	send("window", "OFF")
+	if msg := <-outCh; msg.Text != "[condition:heating_window] Back to normal: Heating with the window open value is inactive" {
+		t.Errorf("unexpected message %q", msg.Text)
+	}
+}
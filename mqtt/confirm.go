@@ -0,0 +1,103 @@
+package mqtt
+
+import (
+	"bytes"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tommyblue/her/her"
+)
+
+// waiter is a command waiting for the device to report the expected state
+type waiter struct {
+	confirmation her.Confirmation
+	confirmed    chan struct{}
+}
+
+// Watch subscribes the topic where a device reports its state, so that commands can be confirmed.
+// It must be called in advance, otherwise the retained state sent by the broker when subscribing
+// would be mistaken for a confirmation
+func (c *Client) Watch(topic string) error {
+	log.Info("Watching ", topic)
+	c.subsMu.Lock()
+	if c.watched == nil {
+		c.watched = make(map[string]bool)
+	}
+	c.watched[topic] = true
+	qos := c.filters()[topic]
+	c.subsMu.Unlock()
+
+	if token := c.mqttClient.Subscribe(topic, qos, c.msgCallback); token.Wait() && token.Error() != nil {
+		c.subsMu.Lock()
+		delete(c.watched, topic)
+		c.subsMu.Unlock()
+		return token.Error()
+	}
+	return nil
+}
+
+// addWaiter registers the confirmation before the command is published, not to miss a quick reply
+func (c *Client) addWaiter(confirmation her.Confirmation) *waiter {
+	w := &waiter{confirmation: confirmation, confirmed: make(chan struct{})}
+	c.waitMu.Lock()
+	c.waiters = append(c.waiters, w)
+	c.waitMu.Unlock()
+	return w
+}
+
+func (c *Client) removeWaiter(w *waiter) {
+	c.waitMu.Lock()
+	defer c.waitMu.Unlock()
+
+	for i, other := range c.waiters {
+		if other == w {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+// waitConfirmation reports whether the device confirmed the command before the timeout
+func (c *Client) waitConfirmation(w *waiter) bool {
+	defer c.removeWaiter(w)
+
+	select {
+	case <-w.confirmed:
+		return true
+	case <-time.After(w.confirmation.Timeout):
+		return false
+	}
+}
+
+// confirm releases the waiters expecting the payload on the topic. Retained messages are ignored,
+// as they carry the state the device had before the command
+func (c *Client) confirm(topic string, payload []byte, retained bool) {
+	if retained {
+		return
+	}
+	c.waitMu.Lock()
+	defer c.waitMu.Unlock()
+
+	waiters := c.waiters[:0]
+	for _, w := range c.waiters {
+		if her.TopicMatches(w.confirmation.Topic, topic) && bytes.Equal(bytes.TrimSpace(payload), []byte(w.confirmation.Payload)) {
+			close(w.confirmed)
+			continue
+		}
+		waiters = append(waiters, w)
+	}
+	c.waiters = waiters
+}
+
+// isWatched reports whether the topic is the state topic of a command
+func (c *Client) isWatched(topic string) bool {
+	c.subsMu.RLock()
+	defer c.subsMu.RUnlock()
+
+	for filter := range c.watched {
+		if her.TopicMatches(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
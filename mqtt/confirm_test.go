@@ -0,0 +1,74 @@
+package mqtt
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/tommyblue/her/her"
+)
+
+func TestConfirm(t *testing.T) {
+	var subscribed []string
+	client := &Client{mqttClient: mqttClientMock{isConnected: true, subscribed: &subscribed}}
+	if err := client.Watch("stat/light/POWER"); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if len(subscribed) != 1 || subscribed[0] != "stat/light/POWER" {
+		t.Errorf("unexpected subscriptions %v", subscribed)
+	}
+
+	w := client.addWaiter(her.Confirmation{Topic: "stat/light/POWER", Payload: "ON", Timeout: time.Second})
+	for _, msg := range []mqttMessageMock{
+		{topic: "stat/light/POWER", payload: []byte("ON"), retained: true},
+		{topic: "stat/light/POWER", payload: []byte("OFF")},
+		{topic: "stat/other/POWER", payload: []byte("ON")},
+	} {
+		client.msgCallback(client.mqttClient, msg)
+	}
+	select {
+	case <-w.confirmed:
+		t.Fatal("Unexpected confirmation")
+	default:
+	}
+
+	client.msgCallback(client.mqttClient, mqttMessageMock{topic: "stat/light/POWER", payload: []byte("ON\n")})
+	if !client.waitConfirmation(w) {
+		t.Error("Expected confirmation")
+	}
+	if len(client.waiters) != 0 {
+		t.Errorf("unexpected waiters %v", client.waiters)
+	}
+
+	w = client.addWaiter(her.Confirmation{Topic: "stat/light/POWER", Payload: "ON", Timeout: 10 * time.Millisecond})
+	if client.waitConfirmation(w) {
+		t.Error("Unexpected confirmation")
+	}
+	if len(client.waiters) != 0 {
+		t.Errorf("unexpected waiters %v", client.waiters)
+	}
+}
+
+func TestConnectConfirm(t *testing.T) {
+	inCh := make(chan her.Message)
+	client := &Client{
+		mqttClient: mqttClientMock{isConnected: true},
+		inCh:       inCh,
+		shutdownCh: make(chan os.Signal, 1),
+	}
+	if err := client.Connect(); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	result := make(chan her.PublishResult, 1)
+	inCh <- her.Message{
+		Topic:   "cmnd/light/POWER",
+		Message: []byte("ON"),
+		Result:  result,
+		Confirm: &her.Confirmation{Topic: "stat/light/POWER", Payload: "ON", Timeout: 10 * time.Millisecond},
+	}
+	r := <-result
+	if r.Status != her.Published || r.Confirmed {
+		t.Errorf("unexpected result %+v", r)
+	}
+}
@@ -0,0 +1,112 @@
+package mqtt
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/spf13/viper"
+	"github.com/tommyblue/her/broker"
+	"github.com/tommyblue/her/her"
+	"github.com/tommyblue/her/state"
+)
+
+func receiveMessage(t *testing.T, ch chan her.Message) her.Message {
+	select {
+	case m := <-ch:
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatalf("message not received")
+	}
+	return her.Message{}
+}
+
+// TestIntegration runs the client against the embedded broker
+func TestIntegration(t *testing.T) {
+	b := broker.New("127.0.0.1:0", nil)
+	if err := b.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	viper.Set("mqtt.broker_url", "tcp://"+b.Addr().String())
+	viper.Set("mqtt.availability_topic", "her/status")
+	defer viper.Set("mqtt.broker_url", nil)
+	defer viper.Set("mqtt.availability_topic", nil)
+
+	// Another device of the network
+	opts := MQTT.NewClientOptions().AddBroker("tcp://" + b.Addr().String()).SetClientID("device")
+	device := MQTT.NewClient(opts)
+	if token := device.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer device.Disconnect(0)
+	device.Publish("zigbee2mqtt/bedroom", 0, true, `{"temperature": 19}`).Wait()
+
+	var stopWg sync.WaitGroup
+	stopWg.Add(1)
+	shutdownCh := make(chan os.Signal, 1)
+	inCh := make(chan her.Message)
+	outCh := make(chan her.Message, 10)
+	client, err := NewClient(&stopWg, shutdownCh, inCh, outCh, state.NewStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	commands := make(chan MQTT.Message, 10)
+	device.Subscribe("home/#", 1, func(_ MQTT.Client, m MQTT.Message) { commands <- m }).Wait()
+	availability := make(chan MQTT.Message, 10)
+	device.Subscribe("her/status", 1, func(_ MQTT.Client, m MQTT.Message) { availability <- m }).Wait()
+
+	err = client.Subscribe(her.SubscriptionConf{
+		Label:    "Temperature",
+		Topic:    "zigbee2mqtt/+",
+		JSONPath: "temperature",
+		Repeat:   true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The retained value is received when subscribing
+	if m := receiveMessage(t, outCh); m.Topic != "zigbee2mqtt/bedroom:temperature" || string(m.Message) != "19" {
+		t.Errorf("unexpected message %s %s", m.Topic, m.Message)
+	}
+
+	device.Publish("zigbee2mqtt/kitchen", 0, false, `{"temperature": 21.5}`).Wait()
+	if m := receiveMessage(t, outCh); m.Topic != "zigbee2mqtt/kitchen:temperature" || string(m.Message) != "21.5" {
+		t.Errorf("unexpected message %s %s", m.Topic, m.Message)
+	}
+
+	retain := false
+	inCh <- her.Message{Topic: "home/light", Message: []byte("ON"), Retain: &retain}
+	select {
+	case m := <-commands:
+		if string(m.Payload()) != "ON" || m.Retained() {
+			t.Errorf("unexpected command %s retained=%v", m.Payload(), m.Retained())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("command not received")
+	}
+
+	// Availability: "online" is retained, "offline" is published at shutdown
+	for _, want := range []string{"online", "offline"} {
+		if want == "offline" {
+			close(shutdownCh)
+			stopWg.Wait()
+		}
+		select {
+		case m := <-availability:
+			if string(m.Payload()) != want {
+				t.Errorf("unexpected availability %s, want %s", m.Payload(), want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("availability %s not received", want)
+		}
+	}
+}
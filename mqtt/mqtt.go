@@ -4,49 +4,186 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"net/url"
 	"os"
-	"strconv"
 	"sync"
+	"time"
 
 	MQTT "github.com/eclipse/paho.mqtt.golang"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
+	"github.com/tommyblue/her/alarm"
 	"github.com/tommyblue/her/her"
+	"github.com/tommyblue/her/notify"
+	"github.com/tommyblue/her/quiet"
+	"github.com/tommyblue/her/state"
 )
 
+// publishTimeout is how long to wait for the broker to acknowledge a publish
+const publishTimeout = 10 * time.Second
+
+// defaultMaxReconnectInterval is the upper bound of the exponential backoff used to reconnect
+const defaultMaxReconnectInterval = 2 * time.Minute
+
 type Client struct {
 	mqttClient    MQTT.Client
-	subscriptions map[string]her.SubscriptionConf
+	subsMu        sync.RWMutex
+	subscriptions []her.SubscriptionConf
+	listeners     map[string]MQTT.MessageHandler
+	watched       map[string]bool
+	conditions    []condition
+	observers     []func(her.Event)
 	stopWg        *sync.WaitGroup
 	shutdownCh    chan os.Signal
 	outCh         chan her.Message
+	sendMu        sync.RWMutex // Held while sending to outCh, so it's not closed meanwhile
+	sendOnce      sync.Once
+	done          chan struct{} // Closed when the client stops sending to outCh
 	inCh          chan her.Message
-	lastMessages  map[string]her.Message
-	lastAlarms    map[string][]byte
+	store         *state.Store
+	dialMu        sync.Mutex
+	dialErr       error // Error of the last TLS connection to the broker
+	lostMu        sync.Mutex
+	lostAt        time.Time
+	qos           byte
+	retain        bool
+	availability  availability
+	pubMu         sync.Mutex
+	queue         *queue
+	waitMu        sync.Mutex
+	waiters       []*waiter
+	templates     *notify.Set // Global templates, nil for the defaults
+	cacheMu       sync.Mutex
+	tplCache      map[tplKey]*notify.Set
+	alarmCache    map[her.AlarmConf]*alarm.Condition
+	alarmMu       sync.Mutex
+	pending       map[string]*pendingAlarm // Alarms waiting for their duration, by alarm id
+	repeating     map[string]*pendingAlarm // Sticky alarms not yet acknowledged, by alarm id
+	silenceMu     sync.Mutex
+	silent        map[string]bool // State keys silent for longer than their max_silence
+	watchdogSince time.Time       // When the watchdog started, the last contact of what never reported
+	watchdogStop  chan struct{}
+	quietHours    *quiet.Schedule // Global quiet hours, nil if not configured
+	quietCache    map[her.QuietHoursConf]*quiet.Schedule
+	heldMu        sync.Mutex
+	held          []heldMessage // Messages held back until the quiet hours end
 }
 
-func NewClient(stopWg *sync.WaitGroup, shutdownCh chan os.Signal, inCh, outCh chan her.Message) (*Client, error) {
-	brokerUrl := viper.GetString("mqtt.broker_url")
-	opts := MQTT.NewClientOptions().AddBroker(brokerUrl)
-	opts.SetClientID("her")
+// availability describes the topic where her announces whether it's online, using a retained birth
+// message on connect and the last will when the connection drops
+type availability struct {
+	topic   string
+	online  string
+	offline string
+}
 
+func NewClient(stopWg *sync.WaitGroup, shutdownCh chan os.Signal, inCh, outCh chan her.Message, store *state.Store) (*Client, error) {
 	client := &Client{
-		subscriptions: make(map[string]her.SubscriptionConf),
-		inCh:          inCh,
-		outCh:         outCh,
-		mqttClient:    MQTT.NewClient(opts),
-		stopWg:        stopWg,
-		shutdownCh:    shutdownCh,
-		lastMessages:  make(map[string]her.Message),
-		lastAlarms:    make(map[string][]byte),
+		inCh:       inCh,
+		outCh:      outCh,
+		done:       make(chan struct{}),
+		stopWg:     stopWg,
+		shutdownCh: shutdownCh,
+		store:      store,
+		qos:        byte(viper.GetUint("mqtt.qos")),
+		retain:     true,
+	}
+
+	if client.qos > 2 {
+		return nil, fmt.Errorf("invalid mqtt.qos %d", client.qos)
+	}
+	if viper.IsSet("mqtt.retain") {
+		client.retain = viper.GetBool("mqtt.retain")
+	}
+
+	client.availability = availability{
+		topic:   viper.GetString("mqtt.availability_topic"),
+		online:  viper.GetString("mqtt.payload_online"),
+		offline: viper.GetString("mqtt.payload_offline"),
+	}
+	if client.availability.online == "" {
+		client.availability.online = "online"
+	}
+	if client.availability.offline == "" {
+		client.availability.offline = "offline"
+	}
+
+	var templates her.TemplatesConf
+	if err := viper.UnmarshalKey("templates", &templates); err != nil {
+		return nil, err
+	}
+	set, err := notify.Compile(templates, nil)
+	if err != nil {
+		return nil, err
+	}
+	client.templates = set
+
+	if viper.IsSet("quiet_hours") {
+		var conf her.QuietHoursConf
+		if err := viper.UnmarshalKey("quiet_hours", &conf); err != nil {
+			return nil, err
+		}
+		if client.quietHours, err = quiet.Compile(conf); err != nil {
+			return nil, err
+		}
+	}
+
+	q, err := newQueue(viper.GetInt("mqtt.queue.size"), viper.GetDuration("mqtt.queue.expiry"), viper.GetString("mqtt.queue.file"))
+	if err != nil {
+		return nil, err
+	}
+	client.queue = q
+
+	maxReconnectInterval := viper.GetDuration("mqtt.max_reconnect_interval")
+	if maxReconnectInterval == 0 {
+		maxReconnectInterval = defaultMaxReconnectInterval
+	}
+
+	clientID := viper.GetString("mqtt.client_id")
+	if clientID == "" {
+		clientID = "her"
+	}
+
+	tlsConfig, err := newTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	brokerUrl := viper.GetString("mqtt.broker_url")
+	opts := MQTT.NewClientOptions().AddBroker(brokerUrl)
+	opts.SetClientID(clientID)
+	opts.SetUsername(viper.GetString("mqtt.username"))
+	opts.SetPassword(viper.GetString("mqtt.password"))
+	if tlsConfig != nil {
+		opts.SetTLSConfig(tlsConfig)
+	}
+	if u, err := url.Parse(brokerUrl); err == nil && tlsSchemes[u.Scheme] && os.Getenv("all_proxy") == "" {
+		opts.SetCustomOpenConnectionFn(client.dialTLS)
+	}
+	// Without an explicit version paho retries refused connections with MQTT 3.1, hiding the reason
+	opts.SetProtocolVersion(4)
+	if client.availability.topic != "" {
+		opts.SetWill(client.availability.topic, client.availability.offline, client.qos, true)
 	}
+	// paho retries with an exponential backoff, starting from 1s up to maxReconnectInterval
+	opts.SetAutoReconnect(true)
+	opts.SetMaxReconnectInterval(maxReconnectInterval)
+	opts.SetOnConnectHandler(client.onConnect)
+	opts.SetConnectionLostHandler(client.onConnectionLost)
+	opts.SetReconnectingHandler(func(MQTT.Client, *MQTT.ClientOptions) {
+		log.Info("Reconnecting to the MQTT broker")
+	})
+	client.mqttClient = MQTT.NewClient(opts)
 
 	return client, nil
 }
 
 func (c *Client) Connect() error {
 	if token := c.mqttClient.Connect(); token.Wait() && token.Error() != nil {
-		return token.Error()
+		c.dialMu.Lock()
+		dialErr := c.dialErr
+		c.dialMu.Unlock()
+		return connectError(token.Error(), dialErr)
 	}
 
 	if !c.mqttClient.IsConnected() {
@@ -57,26 +194,35 @@ func (c *Client) Connect() error {
 		for msg := range c.inCh {
 			log.Debug("Received: ", msg)
 			if msg.Command != "" {
-				switch msg.Command {
-				case "status":
-					statusMessage := ""
-					for _, m := range c.lastMessages {
-						statusMessage = fmt.Sprintf("%s%s: %s\n", statusMessage, c.subscriptions[m.Topic].Label, m.Message)
-					}
-					message := her.Message{
-						Topic:   msg.Command,
-						Message: []byte(statusMessage),
+				log.Error("Unknown command ", msg.Command)
+				continue
+			}
+			var w *waiter
+			if msg.Confirm != nil {
+				w = c.addWaiter(*msg.Confirm)
+			}
+			result := c.PublishOrQueue(msg)
+			if w != nil && result.Status == her.Published {
+				// Wait for the device without holding back the following messages
+				go func(msg her.Message, result her.PublishResult) {
+					result.Confirmed = c.waitConfirmation(w)
+					if msg.Result != nil {
+						msg.Result <- result
 					}
-					c.outCh <- message
-				default:
-					log.Error("Unknown command", msg.Command)
-				}
-			} else if err := c.Publish(msg); err != nil {
-				log.Error(err)
+				}(msg, result)
+				continue
+			}
+			if w != nil {
+				c.removeWaiter(w)
+			}
+			if msg.Result != nil {
+				msg.Result <- result
 			}
 		}
 	}()
 
+	c.startWatchdog()
+
 	go func() {
 		<-c.shutdownCh
 		if err := c.stop(); err != nil {
@@ -89,34 +235,378 @@ func (c *Client) Connect() error {
 }
 
 func (c *Client) Subscribe(s her.SubscriptionConf) error {
+	if _, err := c.templatesFor(s); err != nil {
+		return err
+	}
+	if _, err := c.quietHoursFor(s); err != nil {
+		return err
+	}
+	if _, err := alarm.CompileAll(s.AlarmConfs()); err != nil {
+		return fmt.Errorf("subscription %s: %w", s.Topic, err)
+	}
+	for _, a := range s.AlarmConfs() {
+		if _, err := c.alarmTemplatesFor(s, a); err != nil {
+			return err
+		}
+	}
 	log.Info("Subscribing ", s.Topic, ", repeat: ", s.Repeat, ", repeat_only_if_different: ", s.RepeatOnlyIfDifferent)
-	if token := c.mqttClient.Subscribe(s.Topic, 0, c.msgCallback); token.Wait() && token.Error() != nil {
+	// Many subscriptions can share the same topic, reading different values from its payload. The
+	// broker subscription is refreshed anyway, as the QoS could be higher. The subscription is
+	// registered in advance, as the broker sends the retained messages right away
+	c.subsMu.Lock()
+	c.subscriptions = append(c.subscriptions, s)
+	qos := c.filters()[s.Topic]
+	c.subsMu.Unlock()
+
+	if token := c.mqttClient.Subscribe(s.Topic, qos, c.msgCallback); token.Wait() && token.Error() != nil {
+		c.removeSubscription(s)
 		return token.Error()
 	}
-	c.subscriptions[s.Topic] = s
+	return nil
+}
+
+// removeSubscription forgets the subscription, returning whether its topic is still subscribed
+func (c *Client) removeSubscription(s her.SubscriptionConf) bool {
+	c.subsMu.Lock()
+	defer c.subsMu.Unlock()
+
+	for i, sub := range c.subscriptions {
+		if sub.Topic == s.Topic && sub.JSONPath == s.JSONPath && sub.Label == s.Label && sub.Discovered == s.Discovered {
+			c.subscriptions = append(c.subscriptions[:i], c.subscriptions[i+1:]...)
+			break
+		}
+	}
+	_, used := c.filters()[s.Topic]
+	return used
+}
+
+// Unsubscribe removes a subscription registered by the discovery, unsubscribing from the broker
+// when no other subscription uses its topic. Its state is forgotten, unless another subscription,
+// like a configured one on the same topic, keeps it
+func (c *Client) Unsubscribe(s her.SubscriptionConf) error {
+	if !s.Discovered {
+		return fmt.Errorf("cannot unsubscribe %s, only the discovered subscriptions can be removed", s.Topic)
+	}
+	log.Info("Unsubscribing ", s.Topic)
+	used := c.removeSubscription(s)
+
+	c.subsMu.RLock()
+	remaining := append([]her.SubscriptionConf(nil), c.subscriptions...)
+	c.subsMu.RUnlock()
+	for _, e := range c.store.Snapshot() {
+		if !her.TopicMatches(s.Topic, e.Topic) || e.Key != s.StateKey(e.Topic) {
+			continue
+		}
+		kept := false
+		for _, other := range remaining {
+			if her.TopicMatches(other.Topic, e.Topic) && other.StateKey(e.Topic) == e.Key {
+				kept = true
+				break
+			}
+		}
+		if !kept {
+			c.store.Delete(e.Key)
+		}
+	}
+
+	if used {
+		return nil
+	}
+	if token := c.mqttClient.Unsubscribe(s.Topic); token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+	return nil
+}
+
+// Listen subscribes the handler to the topic filter, bypassing the subscriptions logic. It's meant
+// for internal consumers, like the discovery. As for all paho callbacks, the handler must not block
+func (c *Client) Listen(filter string, handler func(topic string, payload []byte)) error {
+	log.Info("Listening ", filter)
+	callback := func(client MQTT.Client, msg MQTT.Message) {
+		handler(msg.Topic(), msg.Payload())
+	}
+	if token := c.mqttClient.Subscribe(filter, c.qos, callback); token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+
+	c.subsMu.Lock()
+	if c.listeners == nil {
+		c.listeners = make(map[string]MQTT.MessageHandler)
+	}
+	c.listeners[filter] = callback
+	c.subsMu.Unlock()
+	return nil
+}
+
+// Observe calls the handler for each value processed and each alarm triggered. It's meant for
+// internal consumers, like the rules. The handler must not block
+func (c *Client) Observe(handler func(her.Event)) {
+	c.subsMu.Lock()
+	defer c.subsMu.Unlock()
+
+	c.observers = append(c.observers, handler)
+}
+
+func (c *Client) emit(event her.Event) {
+	c.subsMu.RLock()
+	observers := c.observers
+	c.subsMu.RUnlock()
+
+	for _, handler := range observers {
+		handler(event)
+	}
+}
+
+// filters returns the topic filters to subscribe with the highest QoS requested for each of them.
+// It must be called holding subsMu, releasing it before waiting on the broker as paho doesn't
+// dispatch messages (and so can't acknowledge operations) while msgCallback waits for the lock
+func (c *Client) filters() map[string]byte {
+	filters := make(map[string]byte)
+	for _, s := range c.subscriptions {
+		if qos, ok := filters[s.Topic]; !ok || c.subscriptionQoS(s) > qos {
+			filters[s.Topic] = c.subscriptionQoS(s)
+		}
+	}
+	for topic := range c.watched {
+		if _, ok := filters[topic]; !ok {
+			filters[topic] = c.qos
+		}
+	}
+	return filters
+}
+
+// onConnect is called by paho every time the connection is established. The session is clean, so
+// after a reconnection all the subscriptions must be restored
+func (c *Client) onConnect(client MQTT.Client) {
+	log.Info("Connected to the MQTT broker")
+
+	if err := c.resubscribe(); err != nil {
+		log.Error(err)
+	}
+
+	if err := c.publishAvailability(c.availability.online); err != nil {
+		log.Error(err)
+	}
+
+	c.pubMu.Lock()
+	if err := c.flushQueue(); err != nil {
+		log.Error(err)
+	}
+	c.pubMu.Unlock()
+
+	c.lostMu.Lock()
+	lostAt := c.lostAt
+	c.lostAt = time.Time{}
+	c.lostMu.Unlock()
+
+	if !lostAt.IsZero() {
+		outage := time.Since(lostAt).Round(time.Second)
+		// Paho handlers must not block, e.g. waiting for a slow bot
+		go c.send(her.Message{
+			Topic:   "mqtt",
+			Message: []byte(fmt.Sprintf("Broker restored after %s", outage)),
+		})
+	}
+}
+
+func (c *Client) onConnectionLost(client MQTT.Client, err error) {
+	log.Warning("Connection to the MQTT broker lost: ", err)
+
+	c.lostMu.Lock()
+	c.lostAt = time.Now()
+	c.lostMu.Unlock()
+
+	go c.send(her.Message{
+		Topic:   "mqtt",
+		Message: []byte(fmt.Sprintf("Broker lost: %v", err)),
+	})
+}
+
+// send sends the message to the bot, unless the client stopped sending
+func (c *Client) send(msg her.Message) {
+	c.sendMu.RLock()
+	defer c.sendMu.RUnlock()
+
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+	select {
+	case c.outCh <- msg:
+	case <-c.done:
+	}
+}
+
+// StopSending stops sending messages to the bot, waiting for the messages being sent. It must be
+// called before closing the channel to the bot, as paho can still call the handlers
+func (c *Client) StopSending() {
+	c.sendOnce.Do(func() {
+		if c.done != nil {
+			close(c.done)
+		}
+	})
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+}
+
+func (c *Client) resubscribe() error {
+	c.subsMu.RLock()
+	filters := c.filters()
+	listeners := make(map[string]MQTT.MessageHandler, len(c.listeners))
+	for filter, callback := range c.listeners {
+		listeners[filter] = callback
+	}
+	c.subsMu.RUnlock()
+
+	for topic, qos := range filters {
+		log.Info("Restoring subscription ", topic)
+		if token := c.mqttClient.Subscribe(topic, qos, c.msgCallback); token.Wait() && token.Error() != nil {
+			return fmt.Errorf("cannot restore subscription %s: %w", topic, token.Error())
+		}
+	}
+	for filter, callback := range listeners {
+		log.Info("Restoring listener ", filter)
+		if token := c.mqttClient.Subscribe(filter, c.qos, callback); token.Wait() && token.Error() != nil {
+			return fmt.Errorf("cannot restore listener %s: %w", filter, token.Error())
+		}
+	}
 	return nil
 }
 
 func (c *Client) Publish(msg her.Message) error {
-	token := c.mqttClient.Publish(msg.Topic, 0, true, msg.Message)
-	token.Wait()
+	qos, retain := c.qos, c.retain
+	if msg.QoS != nil {
+		qos = *msg.QoS
+	}
+	if msg.Retain != nil {
+		retain = *msg.Retain
+	}
+	token := c.mqttClient.Publish(msg.Topic, qos, retain, msg.Message)
+	if !token.WaitTimeout(publishTimeout) {
+		return fmt.Errorf("timeout publishing to %s", msg.Topic)
+	}
 	return token.Error()
 }
 
+// PublishOrQueue publishes the message, queueing it if the broker is unreachable. Queued messages
+// are published first, to keep the order. The commands of the bot and the rules are published by it.
+// If the queue is disabled, the message fails instead
+func (c *Client) PublishOrQueue(msg her.Message) her.PublishResult {
+	c.pubMu.Lock()
+	defer c.pubMu.Unlock()
+
+	err := MQTT.ErrNotConnected
+	if c.mqttClient.IsConnectionOpen() {
+		err = c.flushQueue()
+		if err == nil {
+			err = c.Publish(msg)
+		}
+		if err == nil {
+			return her.PublishResult{Status: her.Published}
+		}
+		log.Error(err)
+	}
+
+	if c.queue == nil {
+		return her.PublishResult{Status: her.Failed, Err: err}
+	}
+	log.Warning("Broker unreachable, queueing the message to ", msg.Topic)
+	if err := c.queue.push(msg, time.Now()); err != nil {
+		log.Error(err)
+	}
+	return her.PublishResult{Status: her.Queued}
+}
+
+// flushQueue publishes the queued messages in order. It must be called holding pubMu
+func (c *Client) flushQueue() error {
+	if c.queue == nil {
+		return nil
+	}
+	for {
+		msg, ok := c.queue.next(time.Now())
+		if !ok {
+			return nil
+		}
+		if err := c.Publish(msg); err != nil {
+			return fmt.Errorf("cannot publish the queued message to %s: %w", msg.Topic, err)
+		}
+		log.Info("Published the queued message to ", msg.Topic)
+		if err := c.queue.done(); err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+// publishAvailability publishes the retained availability payload, if the topic is configured
+func (c *Client) publishAvailability(payload string) error {
+	if c.availability.topic == "" {
+		return nil
+	}
+	token := c.mqttClient.Publish(c.availability.topic, c.qos, true, payload)
+	token.Wait()
+	if token.Error() != nil {
+		return fmt.Errorf("cannot publish availability %s: %w", payload, token.Error())
+	}
+	return nil
+}
+
+func (c *Client) subscriptionQoS(s her.SubscriptionConf) byte {
+	if s.QoS != nil {
+		return *s.QoS
+	}
+	return c.qos
+}
+
 func (c *Client) stop() error {
 	log.Info("Stopping mqtt")
+	c.StopSending()
 
-	for topic := range c.subscriptions {
+	c.subsMu.Lock()
+	filters := c.filters()
+	for filter := range c.listeners {
+		filters[filter] = c.qos
+	}
+	c.subscriptions = nil
+	c.listeners = nil
+	c.watched = nil
+	c.conditions = nil
+	c.observers = nil
+	c.subsMu.Unlock()
+
+	c.cancelAlarms()
+	c.stopWatchdog()
+
+	for topic := range filters {
 		if token := c.mqttClient.Unsubscribe(topic); token.Wait() && token.Error() != nil {
 			return token.Error()
 		}
-		delete(c.subscriptions, topic)
 	}
+
+	// The last will is not sent on a clean disconnection, so announce it explicitly
+	if err := c.publishAvailability(c.availability.offline); err != nil {
+		log.Error(err)
+	}
+
 	log.Info("Disconnetting MQTT")
 	c.mqttClient.Disconnect(250)
 	return nil
 }
 
+// subscriptionsFor returns the subscriptions whose topic filter matches the concrete topic
+func (c *Client) subscriptionsFor(topic string) []her.SubscriptionConf {
+	c.subsMu.RLock()
+	defer c.subsMu.RUnlock()
+
+	var subscriptions []her.SubscriptionConf
+	for _, s := range c.subscriptions {
+		if her.TopicMatches(s.Topic, topic) {
+			subscriptions = append(subscriptions, s)
+		}
+	}
+	return subscriptions
+}
+
 func (c *Client) msgCallback(client MQTT.Client, msg MQTT.Message) {
 	message := her.Message{
 		Topic:   msg.Topic(),
@@ -127,52 +617,138 @@ func (c *Client) msgCallback(client MQTT.Client, msg MQTT.Message) {
 		return
 	}
 
-	s, ok := c.subscriptions[message.Topic]
-	if !ok {
+	c.confirm(message.Topic, message.Message, msg.Retained())
+
+	subscriptions := c.subscriptionsFor(message.Topic)
+	if len(subscriptions) == 0 {
+		if c.isWatched(message.Topic) {
+			return
+		}
 		log.Errorf("Cannot find topic %s among subscribed topics\n", message.Topic)
 		return
 	}
 
 	log.Info(fmt.Sprintf("Received MQTT message: Topic: %s Message: %s", message.Topic, message.Message))
 
-	if shouldSendMessage(s, message, c.lastMessages[message.Topic].Message) {
-		log.Info(fmt.Sprintf("Sending %v", message))
-		c.outCh <- message
+	for _, s := range subscriptions {
+		if msg.Retained() && s.Retain != nil && !*s.Retain {
+			log.Debug("Ignoring retained message on ", message.Topic)
+			continue
+		}
+
+		value, err := s.Value(message.Message)
+		if err != nil {
+			log.Errorf("Cannot read the value of %s: %v", s.LabelFor(message.Topic), err)
+			continue
+		}
+		c.processValue(s, message.Topic, value)
 	}
-	c.lastMessages[message.Topic] = message
+}
 
-	if err := c.checkAlarm(s, message); err != nil {
+// processValue handles the value of a subscription received on the concrete topic
+func (c *Client) processValue(s her.SubscriptionConf, topic string, value []byte) {
+	key := s.StateKey(topic)
+	display := s.Display(value)
+	message := her.Message{
+		Topic:   key,
+		Message: []byte(display),
+	}
+
+	templates, err := c.templatesFor(s)
+	if err != nil {
 		log.Error(err)
+		return
 	}
-}
 
-func (c *Client) checkAlarm(s her.SubscriptionConf, message her.Message) error {
-	if s.Alarm != nil {
-		v, err := strconv.ParseFloat(string(message.Message), 64)
-		if err != nil {
-			return fmt.Errorf("cannot convert to int the value %v", message)
-		}
+	now := time.Now()
+	prev, _ := c.store.Update(key, topic, s.LabelFor(topic), display, s.Unit, now)
+	c.store.SetRaw(key, string(value), string(s.Convert(value)))
+	data := notify.Data{
+		Key:       key,
+		Label:     s.LabelFor(topic),
+		Topic:     topic,
+		Value:     display,
+		Raw:       string(value),
+		Previous:  prev.Value,
+		Unit:      s.Unit,
+		Timestamp: now,
+		Alarm:     worstAlarm(s.AlarmConfs(), prev),
+		Severity:  prev.Severity(),
+	}
 
-		triggered := false
-		if s.Alarm.Operator == "greater_than" {
-			triggered = v > s.Alarm.Value
-		} else if s.Alarm.Operator == "less_than" {
-			triggered = v < s.Alarm.Value
-		} else if s.Alarm.Operator == "equal_to" {
-			triggered = v == s.Alarm.Value
+	if shouldSendMessage(s, message, []byte(prev.Value)) {
+		if message.Text, err = templates.Notification(data); err != nil {
+			log.Error(err)
 		} else {
-			return fmt.Errorf("unknown operator %s", s.Alarm.Operator)
+			c.deliver(s, data, message, "", true)
 		}
+	}
 
-		if triggered && !bytes.Equal(c.lastAlarms[message.Topic], message.Message) {
-			c.outCh <- her.Message{
-				Topic:   s.Topic,
-				Message: []byte(fmt.Sprintf("Alarm: %s value is %.2f", s.Label, v)),
-			}
-			c.lastAlarms[message.Topic] = message.Message
-		}
+	c.checkSilence(s, data)
+	c.checkAlarms(s, data, s.Convert(value))
+	c.updateStatusLine(s, templates, data)
+	c.emit(her.Event{Key: key, Value: display, Raw: string(value), Converted: string(s.Convert(value))})
+	c.checkConditions(key)
+}
+
+// updateStatusLine formats the status line with the current alarms
+func (c *Client) updateStatusLine(s her.SubscriptionConf, templates *notify.Set, data notify.Data) {
+	entry, _ := c.store.Get(data.Key)
+	data.Alarm = worstAlarm(s.AlarmConfs(), entry)
+	data.Severity = entry.Severity()
+
+	line, err := templates.Status(data)
+	if err != nil {
+		log.Error(err)
+		return
 	}
-	return nil
+	c.store.SetStatusLine(data.Key, line)
+}
+
+// tplKey identifies the templates of a subscription, with the message of one of its alarms
+type tplKey struct {
+	templates her.TemplatesConf
+	alarm     string
+}
+
+// templatesFor returns the templates of the subscription, compiling them the first time
+func (c *Client) templatesFor(s her.SubscriptionConf) (*notify.Set, error) {
+	t, err := c.compileTemplates(tplKey{templates: s.Templates}, s.Templates, c.templates)
+	if err != nil {
+		return nil, fmt.Errorf("subscription %s: %w", s.Topic, err)
+	}
+	return t, nil
+}
+
+// alarmTemplatesFor returns the templates of the alarm, using its message if set
+func (c *Client) alarmTemplatesFor(s her.SubscriptionConf, a her.AlarmConf) (*notify.Set, error) {
+	templates, err := c.templatesFor(s)
+	if err != nil || a.Message == "" {
+		return templates, err
+	}
+	t, err := c.compileTemplates(tplKey{templates: s.Templates, alarm: a.Message}, her.TemplatesConf{Alarm: a.Message}, templates)
+	if err != nil {
+		return nil, fmt.Errorf("alarm %s of %s: %w", a.Name, s.Topic, err)
+	}
+	return t, nil
+}
+
+func (c *Client) compileTemplates(key tplKey, conf her.TemplatesConf, fallback *notify.Set) (*notify.Set, error) {
+	c.cacheMu.Lock()
+	defer c.cacheMu.Unlock()
+
+	if t, ok := c.tplCache[key]; ok {
+		return t, nil
+	}
+	t, err := notify.Compile(conf, fallback)
+	if err != nil {
+		return nil, err
+	}
+	if c.tplCache == nil {
+		c.tplCache = make(map[tplKey]*notify.Set)
+	}
+	c.tplCache[key] = t
+	return t, nil
 }
 
 func shouldSendMessage(s her.SubscriptionConf, message her.Message, lastMessage []byte) bool {
@@ -6,13 +6,13 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
-	"sync"
 	"syscall"
 	"testing"
 	"time"
 
 	MQTT "github.com/eclipse/paho.mqtt.golang"
 	"github.com/tommyblue/her/her"
+	"github.com/tommyblue/her/state"
 )
 
 func TestShouldSendMessage(t *testing.T) {
@@ -73,12 +73,15 @@ func TestShouldSendMessage(t *testing.T) {
 }
 
 type mqttClientMock struct {
-	tokenError  error
-	isConnected bool
+	tokenError   error
+	isConnected  bool
+	subscribed   *[]string
+	published    *[]string
+	unsubscribed *[]string
 }
 
 func (m mqttClientMock) IsConnected() bool      { return m.isConnected }
-func (m mqttClientMock) IsConnectionOpen() bool { return true }
+func (m mqttClientMock) IsConnectionOpen() bool { return m.isConnected }
 func (m mqttClientMock) Connect() MQTT.Token {
 	return mqttTokenMock{
 		errorReturn: m.tokenError,
@@ -87,15 +90,26 @@ func (m mqttClientMock) Connect() MQTT.Token {
 }
 func (m mqttClientMock) Disconnect(quiesce uint) {}
 func (m mqttClientMock) Publish(topic string, qos byte, retained bool, payload interface{}) MQTT.Token {
+	if m.published != nil {
+		*m.published = append(*m.published, fmt.Sprintf("%s %s qos=%d retain=%v", topic, payload, qos, retained))
+	}
 	return mqttTokenMock{}
 }
 func (m mqttClientMock) Subscribe(topic string, qos byte, callback MQTT.MessageHandler) MQTT.Token {
+	if m.subscribed != nil {
+		*m.subscribed = append(*m.subscribed, topic)
+	}
 	return mqttTokenMock{}
 }
 func (m mqttClientMock) SubscribeMultiple(filters map[string]byte, callback MQTT.MessageHandler) MQTT.Token {
 	return mqttTokenMock{}
 }
-func (m mqttClientMock) Unsubscribe(topics ...string) MQTT.Token             { return mqttTokenMock{} }
+func (m mqttClientMock) Unsubscribe(topics ...string) MQTT.Token {
+	if m.unsubscribed != nil {
+		*m.unsubscribed = append(*m.unsubscribed, topics...)
+	}
+	return mqttTokenMock{}
+}
 func (m mqttClientMock) AddRoute(topic string, callback MQTT.MessageHandler) {}
 func (m mqttClientMock) OptionsReader() MQTT.ClientOptionsReader             { return MQTT.ClientOptionsReader{} }
 
@@ -138,49 +152,493 @@ func TestConnect(t *testing.T) {
 
 func TestConnectInCh(t *testing.T) {
 	inCh := make(chan her.Message)
-	outCh := make(chan her.Message)
 	shutdownCh := make(chan os.Signal, 1)
-	l := make(map[string]her.Message)
-	l["test"] = her.Message{
-		Topic:   "t",
-		Message: []byte("m"),
-	}
-	s := make(map[string]her.SubscriptionConf)
-	s[l["test"].Topic] = her.SubscriptionConf{
-		Label: "l",
-	}
-	wantMsg := "l: m\n"
+	var published []string
 	client := &Client{
 		mqttClient: mqttClientMock{
 			tokenError:  nil,
 			isConnected: true,
+			published:   &published,
 		},
-		inCh:          inCh,
-		outCh:         outCh,
-		shutdownCh:    shutdownCh,
-		lastMessages:  l,
-		subscriptions: s,
+		inCh:       inCh,
+		shutdownCh: shutdownCh,
+		retain:     true,
 	}
 	err := client.Connect()
 	if err != nil {
 		t.Errorf("Should not return error")
 	}
 
-	var wg sync.WaitGroup
-	wg.Add(1)
-	go func() {
-		msg := <-outCh
-		if !bytes.Equal(msg.Message, []byte(wantMsg)) {
-			t.Errorf("unexpected message %s", msg.Message)
+	inCh <- her.Message{Topic: "t", Message: []byte("m")}
+	// Messages are handled in order, so the first one is published once the second is received
+	inCh <- her.Message{Command: "unknown"}
+
+	want := []string{"t m qos=0 retain=true"}
+	if fmt.Sprint(published) != fmt.Sprint(want) {
+		t.Errorf("got %q, want %q", published, want)
+	}
+
+	signal.Notify(shutdownCh, os.Interrupt, syscall.SIGTERM)
+}
+
+type mqttMessageMock struct {
+	topic    string
+	payload  []byte
+	retained bool
+}
+
+func (m mqttMessageMock) Duplicate() bool   { return false }
+func (m mqttMessageMock) Qos() byte         { return 0 }
+func (m mqttMessageMock) Retained() bool    { return m.retained }
+func (m mqttMessageMock) Topic() string     { return m.topic }
+func (m mqttMessageMock) MessageID() uint16 { return 0 }
+func (m mqttMessageMock) Payload() []byte   { return m.payload }
+func (m mqttMessageMock) Ack()              {}
+
+func TestMsgCallbackWildcard(t *testing.T) {
+	outCh := make(chan her.Message, 10)
+	client := &Client{
+		outCh: outCh,
+		store: state.NewStore(),
+		subscriptions: []her.SubscriptionConf{{
+			Label:                 "Temperature",
+			Topic:                 "zigbee2mqtt/+/temperature",
+			Repeat:                true,
+			RepeatOnlyIfDifferent: true,
+			Alarm:                 &her.AlarmConf{Operator: "greater_than", Value: 30},
+		}},
+	}
+
+	client.msgCallback(nil, mqttMessageMock{topic: "zigbee2mqtt/kitchen/temperature", payload: []byte("21")})
+	client.msgCallback(nil, mqttMessageMock{topic: "zigbee2mqtt/bedroom/temperature", payload: []byte("21")})
+	// Same value on the same concrete topic must not be repeated
+	client.msgCallback(nil, mqttMessageMock{topic: "zigbee2mqtt/kitchen/temperature", payload: []byte("21")})
+	client.msgCallback(nil, mqttMessageMock{topic: "zigbee2mqtt/bedroom/temperature", payload: []byte("31")})
+	// Not matching the filter
+	client.msgCallback(nil, mqttMessageMock{topic: "zigbee2mqtt/kitchen/humidity", payload: []byte("50")})
+	close(outCh)
+
+	want := []string{
+		"[zigbee2mqtt/kitchen/temperature] 21",
+		"[zigbee2mqtt/bedroom/temperature] 21",
+		"[zigbee2mqtt/bedroom/temperature] 31",
+		"[zigbee2mqtt/bedroom/temperature] Alarm: Temperature (zigbee2mqtt/bedroom/temperature) value is 31",
+	}
+	var got []string
+	for msg := range outCh {
+		got = append(got, msg.Text)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if len(client.store.Snapshot()) != 2 {
+		t.Errorf("expected 2 concrete topics in the state, got %d", len(client.store.Snapshot()))
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	outCh := make(chan her.Message, 10)
+	var subscribed []string
+	client := &Client{
+		mqttClient: mqttClientMock{
+			isConnected: true,
+			subscribed:  &subscribed,
+		},
+		outCh: outCh,
+	}
+	if err := client.Subscribe(her.SubscriptionConf{Topic: "sensor/temperature"}); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	// First connection: nothing to notify
+	client.onConnect(client.mqttClient)
+	if len(outCh) != 0 {
+		t.Errorf("Unexpected message at first connection")
+	}
+
+	client.onConnectionLost(client.mqttClient, errors.New("EOF"))
+	msg := <-outCh
+	if string(msg.Message) != "Broker lost: EOF" {
+		t.Errorf("unexpected message %s", msg.Message)
+	}
+
+	client.onConnect(client.mqttClient)
+	msg = <-outCh
+	if !bytes.HasPrefix(msg.Message, []byte("Broker restored after ")) {
+		t.Errorf("unexpected message %s", msg.Message)
+	}
+
+	want := []string{"sensor/temperature", "sensor/temperature", "sensor/temperature"}
+	if fmt.Sprint(subscribed) != fmt.Sprint(want) {
+		t.Errorf("got subscriptions %v, want %v", subscribed, want)
+	}
+}
+
+func TestStopSending(t *testing.T) {
+	outCh := make(chan her.Message)
+	client := &Client{
+		mqttClient: mqttClientMock{},
+		outCh:      outCh,
+		done:       make(chan struct{}),
+	}
+
+	// Paho handlers don't wait for the bot
+	client.onConnectionLost(client.mqttClient, errors.New("EOF"))
+	client.StopSending()
+	close(outCh)
+
+	// Sending on the closed channel panics
+	client.onConnectionLost(client.mqttClient, errors.New("EOF"))
+	client.onConnect(client.mqttClient)
+	client.send(her.Message{Topic: "t"})
+	time.Sleep(10 * time.Millisecond)
+}
+
+func TestPublishQoSRetain(t *testing.T) {
+	var published []string
+	client := &Client{
+		mqttClient: mqttClientMock{published: &published},
+		qos:        0,
+		retain:     true,
+	}
+	qos := byte(1)
+	retain := false
+
+	msgs := []her.Message{
+		{Topic: "default", Message: []byte("ON")},
+		{Topic: "qos", Message: []byte("ON"), QoS: &qos},
+		{Topic: "retain", Message: []byte("ON"), Retain: &retain},
+	}
+	for _, msg := range msgs {
+		if err := client.Publish(msg); err != nil {
+			t.Errorf("Unexpected error %v", err)
 		}
+	}
+
+	want := []string{
+		"default ON qos=0 retain=true",
+		"qos ON qos=1 retain=true",
+		"retain ON qos=0 retain=false",
+	}
+	if fmt.Sprint(published) != fmt.Sprint(want) {
+		t.Errorf("got %q, want %q", published, want)
+	}
+}
 
-		wg.Done()
-	}()
+func TestMsgCallbackIgnoreRetained(t *testing.T) {
+	outCh := make(chan her.Message, 10)
+	retain := false
+	client := &Client{
+		outCh:         outCh,
+		store:         state.NewStore(),
+		subscriptions: []her.SubscriptionConf{{Topic: "doorbell", Repeat: true, Retain: &retain}},
+	}
+
+	client.msgCallback(nil, mqttMessageMock{topic: "doorbell", payload: []byte("ring"), retained: true})
+	if len(outCh) != 0 {
+		t.Errorf("Retained message must be ignored")
+	}
+	client.msgCallback(nil, mqttMessageMock{topic: "doorbell", payload: []byte("ring")})
+	if len(outCh) != 1 {
+		t.Errorf("Message not sent")
+	}
+}
 
-	inCh <- her.Message{
-		Command: "status",
+func TestAvailability(t *testing.T) {
+	var published []string
+	client := &Client{
+		mqttClient: mqttClientMock{isConnected: true, published: &published},
+		qos:        1,
+		availability: availability{
+			topic:   "her/status",
+			online:  "online",
+			offline: "offline",
+		},
 	}
-	wg.Wait()
 
-	signal.Notify(shutdownCh, os.Interrupt, syscall.SIGTERM)
+	client.onConnect(client.mqttClient)
+	if err := client.stop(); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	want := []string{
+		"her/status online qos=1 retain=true",
+		"her/status offline qos=1 retain=true",
+	}
+	if fmt.Sprint(published) != fmt.Sprint(want) {
+		t.Errorf("got %q, want %q", published, want)
+	}
+}
+
+func TestMsgCallbackJSONPath(t *testing.T) {
+	outCh := make(chan her.Message, 10)
+	client := &Client{
+		outCh: outCh,
+		store: state.NewStore(),
+		subscriptions: []her.SubscriptionConf{
+			{
+				Label:    "Temperature",
+				Topic:    "zigbee2mqtt/kitchen",
+				JSONPath: "temperature",
+				Repeat:   true,
+				Alarm:    &her.AlarmConf{Operator: "greater_than", Value: 30},
+			},
+			{
+				Label:    "Humidity",
+				Topic:    "zigbee2mqtt/kitchen",
+				JSONPath: "humidity",
+				Repeat:   true,
+			},
+			{
+				Label:    "Power",
+				Topic:    "zigbee2mqtt/kitchen",
+				JSONPath: "state.power[0]",
+			},
+		},
+	}
+
+	client.msgCallback(nil, mqttMessageMock{
+		topic:   "zigbee2mqtt/kitchen",
+		payload: []byte(`{"temperature": 31.5, "humidity": 60, "state": {"power": [120]}}`),
+	})
+	close(outCh)
+
+	want := []string{
+		"[zigbee2mqtt/kitchen:temperature] 31.5",
+		"[zigbee2mqtt/kitchen:temperature] Alarm: Temperature value is 31.5",
+		"[zigbee2mqtt/kitchen:humidity] 60",
+	}
+	var got []string
+	for msg := range outCh {
+		got = append(got, msg.Text)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if e, _ := client.store.Get("zigbee2mqtt/kitchen:state.power[0]"); e.Value != "120" {
+		t.Errorf("unexpected power value %s", e.Value)
+	}
+	if e, _ := client.store.Get("zigbee2mqtt/kitchen:humidity"); e.Label != "Humidity" {
+		t.Errorf("unexpected label %s", e.Label)
+	}
+	if e, _ := client.store.Get("zigbee2mqtt/kitchen:temperature"); !e.Alarms["greater_than"].Active || e.Alarms["greater_than"].Value != "31.5" {
+		t.Errorf("unexpected alarm state %+v", e.Alarms)
+	}
+}
+
+func TestUnsubscribe(t *testing.T) {
+	var subscribed, unsubscribed []string
+	client := &Client{
+		mqttClient: mqttClientMock{subscribed: &subscribed, unsubscribed: &unsubscribed},
+		outCh:      make(chan her.Message, 10),
+		store:      state.NewStore(),
+	}
+	temperature := her.SubscriptionConf{Label: "Temperature", Topic: "kitchen", JSONPath: "temperature", Discovered: true}
+	humidity := her.SubscriptionConf{Label: "Humidity", Topic: "kitchen", JSONPath: "humidity", Discovered: true}
+	configured := her.SubscriptionConf{Label: "Humidity", Topic: "kitchen", JSONPath: "humidity"}
+	for _, s := range []her.SubscriptionConf{temperature, humidity, configured} {
+		if err := client.Subscribe(s); err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+	}
+	if err := client.Listen("homeassistant/+/+/config", func(string, []byte) {}); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	client.msgCallback(nil, mqttMessageMock{topic: "kitchen", payload: []byte(`{"temperature": 21, "humidity": 50}`)})
+
+	// The topic is still used by the humidity
+	if err := client.Unsubscribe(temperature); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if len(unsubscribed) != 0 {
+		t.Errorf("Unexpected broker unsubscription %v", unsubscribed)
+	}
+	if _, ok := client.store.Get("kitchen:temperature"); ok {
+		t.Errorf("State not removed")
+	}
+	if _, ok := client.store.Get("kitchen:humidity"); !ok {
+		t.Errorf("Unexpected state removal")
+	}
+
+	// The configured subscription on the same topic keeps the topic and the state
+	if err := client.Unsubscribe(humidity); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if len(unsubscribed) != 0 {
+		t.Errorf("Unexpected broker unsubscription %v", unsubscribed)
+	}
+	if _, ok := client.store.Get("kitchen:humidity"); !ok {
+		t.Errorf("Unexpected state removal")
+	}
+	if len(client.subscriptions) != 1 || client.subscriptions[0].Discovered {
+		t.Errorf("Unexpected subscriptions %+v", client.subscriptions)
+	}
+	if err := client.Unsubscribe(configured); err == nil {
+		t.Error("Expected error removing a configured subscription")
+	}
+
+	// Subscriptions and listeners are restored on reconnection
+	subscribed = nil
+	if err := client.resubscribe(); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if fmt.Sprint(subscribed) != "[kitchen homeassistant/+/+/config]" {
+		t.Errorf("Unexpected subscriptions %v", subscribed)
+	}
+}
+
+func TestMsgCallbackTemplates(t *testing.T) {
+	outCh := make(chan her.Message, 10)
+	client := &Client{
+		outCh: outCh,
+		store: state.NewStore(),
+		subscriptions: []her.SubscriptionConf{{
+			Label:  "Kitchen temperature",
+			Topic:  "sensor/temperature",
+			Repeat: true,
+			Unit:   "°C",
+			Alarm:  &her.AlarmConf{Operator: "greater_than", Value: 22},
+			Templates: her.TemplatesConf{
+				Notification: "{{.Label}} {{.Trend}} to {{.Value}} {{.Unit}}{{with .Previous}} (was {{.}}){{end}}",
+				Alarm:        "🔥 {{.Label}} is above {{.Alarm.Threshold}} {{.Unit}}",
+				Status:       "{{.Label}}: {{.Value}} {{.Unit}}{{if .Alarm.Active}} 🔥{{end}}",
+			},
+		}},
+	}
+
+	client.msgCallback(nil, mqttMessageMock{topic: "sensor/temperature", payload: []byte("21.0")})
+	if e, _ := client.store.Get("sensor/temperature"); e.StatusLine != "Kitchen temperature: 21.0 °C" {
+		t.Errorf("unexpected status line %q", e.StatusLine)
+	}
+	client.msgCallback(nil, mqttMessageMock{topic: "sensor/temperature", payload: []byte("23.4")})
+	close(outCh)
+
+	want := []string{
+		"Kitchen temperature changed to 21.0 °C",
+		"Kitchen temperature rose to 23.4 °C (was 21.0)",
+		"🔥 Kitchen temperature is above 22 °C",
+	}
+	var got []string
+	for msg := range outCh {
+		got = append(got, msg.Text)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if e, _ := client.store.Get("sensor/temperature"); e.StatusLine != "Kitchen temperature: 23.4 °C 🔥" {
+		t.Errorf("unexpected status line %q", e.StatusLine)
+	}
+}
+
+func TestMsgCallbackFormat(t *testing.T) {
+	outCh := make(chan her.Message, 10)
+	precision := 2
+	scale := 0.001
+	client := &Client{
+		outCh: outCh,
+		store: state.NewStore(),
+		subscriptions: []her.SubscriptionConf{
+			{
+				Label:     "Pressure",
+				Topic:     "boiler/pressure",
+				Repeat:    true,
+				Unit:      "bar",
+				Scale:     &scale,
+				Precision: &precision,
+				Alarm:     &her.AlarmConf{Operator: "greater_than", Value: 2.5},
+			},
+			{
+				Label:  "Door",
+				Topic:  "door/contact",
+				Repeat: true,
+				Values: map[string]string{"on": "open", "off": "closed"},
+			},
+		},
+	}
+
+	client.msgCallback(nil, mqttMessageMock{topic: "boiler/pressure", payload: []byte("2512")})
+	client.msgCallback(nil, mqttMessageMock{topic: "door/contact", payload: []byte("ON")})
+	close(outCh)
+
+	want := []string{
+		"[boiler/pressure] 2.51 bar",
+		"[boiler/pressure] Alarm: Pressure value is 2.51 bar",
+		"[door/contact] open",
+	}
+	var got []string
+	for msg := range outCh {
+		got = append(got, msg.Text)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if e, _ := client.store.Get("boiler/pressure"); e.Value != "2.51" || e.Unit != "bar" || e.StatusLine != "Pressure: 2.51 bar (warning)" {
+		t.Errorf("unexpected entry %+v", e)
+	}
+	if e, _ := client.store.Get("door/contact"); e.Value != "open" || e.StatusLine != "Door: open" {
+		t.Errorf("unexpected entry %+v", e)
+	}
+}
+
+func TestMsgCallbackStringAlarm(t *testing.T) {
+	outCh := make(chan her.Message, 10)
+	client := &Client{
+		outCh: outCh,
+		store: state.NewStore(),
+		subscriptions: []her.SubscriptionConf{{
+			Label:  "Front door",
+			Topic:  "door/front",
+			Values: map[string]string{"open": "open", "closed": "closed"},
+			Alarm:  &her.AlarmConf{Operator: "equals", Text: "OPEN"},
+		}},
+	}
+
+	client.msgCallback(nil, mqttMessageMock{topic: "door/front", payload: []byte("CLOSED")})
+	client.msgCallback(nil, mqttMessageMock{topic: "door/front", payload: []byte("OPEN")})
+	close(outCh)
+
+	want := []string{"[door/front] Alarm: Front door value is open"}
+	var got []string
+	for msg := range outCh {
+		got = append(got, msg.Text)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestMsgCallbackAlarmRecovery(t *testing.T) {
+	outCh := make(chan her.Message, 10)
+	client := &Client{
+		outCh: outCh,
+		store: state.NewStore(),
+		subscriptions: []her.SubscriptionConf{{
+			Label: "Temperature",
+			Topic: "sensor/temperature",
+			Alarm: &her.AlarmConf{Operator: "greater_than", Value: 20, Hysteresis: 0.5},
+		}},
+	}
+
+	for _, v := range []string{"19", "20.1", "20.2", "20.3", "19.8", "19.4", "20.1"} {
+		client.msgCallback(nil, mqttMessageMock{topic: "sensor/temperature", payload: []byte(v)})
+	}
+	close(outCh)
+
+	want := []string{
+		"[sensor/temperature] Alarm: Temperature value is 20.1",
+		"[sensor/temperature] Back to normal: Temperature value is 19.4",
+		"[sensor/temperature] Alarm: Temperature value is 20.1",
+	}
+	var got []string
+	for msg := range outCh {
+		got = append(got, msg.Text)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if e, _ := client.store.Get("sensor/temperature"); !e.Alarms["greater_than"].Active || e.Alarms["greater_than"].ClearedAt.IsZero() {
+		t.Errorf("unexpected alarm state %+v", e.Alarms)
+	}
 }
@@ -0,0 +1,124 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tommyblue/her/her"
+	"github.com/tommyblue/her/state"
+)
+
+const (
+	defaultQueueSize   = 100
+	defaultQueueExpiry = time.Hour
+)
+
+// queue holds the messages to publish once the broker is reachable again. It's bounded, dropping the
+// oldest messages when full, and optionally saved to a file to survive restarts. A negative size
+// disables it
+type queue struct {
+	size     int
+	expiry   time.Duration
+	file     string
+	messages []queuedMessage
+}
+
+type queuedMessage struct {
+	Topic    string    `json:"topic"`
+	Message  []byte    `json:"message"`
+	QoS      *byte     `json:"qos,omitempty"`
+	Retain   *bool     `json:"retain,omitempty"`
+	QueuedAt time.Time `json:"queued_at"`
+}
+
+// newQueue returns the queue, loading the messages saved in the file if any. It returns nil if the
+// queue is disabled
+func newQueue(size int, expiry time.Duration, file string) (*queue, error) {
+	if size < 0 {
+		return nil, nil
+	}
+	if size == 0 {
+		size = defaultQueueSize
+	}
+	if expiry == 0 {
+		expiry = defaultQueueExpiry
+	}
+	q := &queue{
+		size:   size,
+		expiry: expiry,
+		file:   file,
+	}
+
+	if file == "" {
+		return q, nil
+	}
+	data, err := os.ReadFile(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot load the publish queue: %w", err)
+	}
+	if err := json.Unmarshal(data, &q.messages); err != nil {
+		return nil, fmt.Errorf("cannot load the publish queue from %s: %w", file, err)
+	}
+	return q, nil
+}
+
+func (q *queue) len() int {
+	return len(q.messages)
+}
+
+func (q *queue) push(msg her.Message, now time.Time) error {
+	q.messages = append(q.messages, queuedMessage{
+		Topic:    msg.Topic,
+		Message:  msg.Message,
+		QoS:      msg.QoS,
+		Retain:   msg.Retain,
+		QueuedAt: now,
+	})
+	if len(q.messages) > q.size {
+		log.Warning("Publish queue full, dropping the message to ", q.messages[0].Topic)
+		q.messages = q.messages[1:]
+	}
+	return q.save()
+}
+
+// next drops the expired messages and returns the oldest one, leaving it in the queue until done
+// is called
+func (q *queue) next(now time.Time) (her.Message, bool) {
+	for len(q.messages) > 0 {
+		m := q.messages[0]
+		if now.Sub(m.QueuedAt) <= q.expiry {
+			return her.Message{Topic: m.Topic, Message: m.Message, QoS: m.QoS, Retain: m.Retain}, true
+		}
+		log.Warningf("Dropping the message to %s, queued at %s", m.Topic, m.QueuedAt.Format(time.RFC3339))
+		q.messages = q.messages[1:]
+	}
+	return her.Message{}, false
+}
+
+// done removes the message returned by next, once published
+func (q *queue) done() error {
+	q.messages = q.messages[1:]
+	return q.save()
+}
+
+func (q *queue) save() error {
+	if q.file == "" {
+		return nil
+	}
+	data, err := json.Marshal(q.messages)
+	if err != nil {
+		return err
+	}
+	if err := state.WriteFile(q.file, data); err != nil {
+		return fmt.Errorf("cannot save the publish queue: %w", err)
+	}
+	return nil
+}
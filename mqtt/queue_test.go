@@ -0,0 +1,113 @@
+package mqtt
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/tommyblue/her/her"
+)
+
+func TestQueue(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "queue.json")
+	q, err := newQueue(2, time.Minute, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+
+	for i, topic := range []string{"a", "b", "c"} {
+		if err := q.push(her.Message{Topic: topic, Message: []byte("ON")}, now.Add(time.Duration(i)*time.Second)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The queue is bounded, so the oldest message has been dropped
+	if q.len() != 2 {
+		t.Errorf("unexpected length %d", q.len())
+	}
+
+	// The queue is saved at each change
+	loaded, err := newQueue(2, time.Minute, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, ok := loaded.next(now)
+	if !ok || msg.Topic != "b" || string(msg.Message) != "ON" {
+		t.Errorf("unexpected message %v", msg)
+	}
+	// next doesn't remove the message until done
+	if msg, _ := loaded.next(now); msg.Topic != "b" {
+		t.Errorf("unexpected message %v", msg)
+	}
+	if err := loaded.done(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Expired messages are dropped
+	if _, ok := loaded.next(now.Add(2 * time.Minute)); ok {
+		t.Errorf("Expired message returned")
+	}
+	if loaded.len() != 0 {
+		t.Errorf("unexpected length %d", loaded.len())
+	}
+}
+
+func TestPublishOrQueue(t *testing.T) {
+	var published []string
+	q, _ := newQueue(0, 0, "")
+	client := &Client{
+		mqttClient: mqttClientMock{isConnected: false, published: &published},
+		queue:      q,
+	}
+
+	for _, topic := range []string{"first", "second"} {
+		result := client.PublishOrQueue(her.Message{Topic: topic, Message: []byte("ON")})
+		if result.Status != her.Queued {
+			t.Errorf("unexpected status %v", result.Status)
+		}
+	}
+	if len(published) != 0 {
+		t.Errorf("unexpected publish %v", published)
+	}
+
+	// Once connected, queued messages are published first
+	client.mqttClient = mqttClientMock{isConnected: true, published: &published}
+	result := client.PublishOrQueue(her.Message{Topic: "third", Message: []byte("ON")})
+	if result.Status != her.Published {
+		t.Errorf("unexpected status %v", result.Status)
+	}
+	want := []string{"first ON qos=0 retain=false", "second ON qos=0 retain=false", "third ON qos=0 retain=false"}
+	if fmt.Sprint(published) != fmt.Sprint(want) {
+		t.Errorf("got %q, want %q", published, want)
+	}
+
+	// A negative size disables the queue: messages fail
+	q, err := newQueue(-1, 0, "")
+	if err != nil || q != nil {
+		t.Fatalf("unexpected queue %v, error %v", q, err)
+	}
+	client = &Client{mqttClient: mqttClientMock{isConnected: false}, queue: q}
+	if result := client.PublishOrQueue(her.Message{Topic: "t"}); result.Status != her.Failed || result.Err != MQTT.ErrNotConnected {
+		t.Errorf("unexpected result %v", result)
+	}
+}
+
+func TestFlushQueueOnConnect(t *testing.T) {
+	var published []string
+	q, _ := newQueue(0, 0, "")
+	client := &Client{
+		mqttClient: mqttClientMock{isConnected: false, published: &published},
+		outCh:      make(chan her.Message, 10),
+		queue:      q,
+		retain:     true,
+	}
+	client.PublishOrQueue(her.Message{Topic: "light", Message: []byte("ON")})
+
+	client.mqttClient = mqttClientMock{isConnected: true, published: &published}
+	client.onConnect(client.mqttClient)
+	if fmt.Sprint(published) != "[light ON qos=0 retain=true]" || q.len() != 0 {
+		t.Errorf("queue not flushed: %v", published)
+	}
+}
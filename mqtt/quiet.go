@@ -0,0 +1,163 @@
+package mqtt
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tommyblue/her/her"
+	"github.com/tommyblue/her/notify"
+	"github.com/tommyblue/her/quiet"
+)
+
+// summaryLimit is the longest summary of the quiet hours sent at once, the limit of Telegram
+const summaryLimit = 4096
+
+// maxHeld is the most messages held during the quiet hours, the oldest are dropped beyond it
+const maxHeld = 1000
+
+// heldMessage is a message held back until the quiet hours end. Only the latest value notification
+// of each subscription and key is kept, while alarms, recoveries and silences are all kept in order
+type heldMessage struct {
+	subscription string
+	key          string
+	replace      bool // A value notification, replaced by the next one
+	release      time.Time
+	msg          her.Message
+}
+
+// deliver sends a message of the subscription to the bot, unless it has been muted. During the quiet
+// hours the message is held back, unless its severity bypasses them. Notifications have no severity.
+// replace is set for the value notifications, which are only summarized with the latest value
+func (c *Client) deliver(s her.SubscriptionConf, data notify.Data, msg her.Message, severity string, replace bool) {
+	now := time.Now()
+	if c.muted(s, data, now) {
+		log.Info("Muted: ", msg.Text)
+		return
+	}
+
+	schedule, err := c.quietHoursFor(s)
+	if err != nil {
+		log.Error(err)
+	} else if schedule != nil && schedule.Active(now) && !schedule.Bypass(severity) {
+		log.Info("Held for the quiet hours: ", msg.Text)
+		c.hold(heldMessage{subscription: s.Topic, key: data.Key, replace: replace, release: schedule.End(now), msg: msg})
+		return
+	}
+
+	log.Info(fmt.Sprintf("Sending %v", msg))
+	c.send(msg)
+}
+
+// muted reports whether the notifications and the alarms of the subscription have been muted from
+// the bot, by label, topic filter, concrete topic or state key
+func (c *Client) muted(s her.SubscriptionConf, data notify.Data, now time.Time) bool {
+	return c.store.Muted(now, s.Label, s.Topic, data.Topic, data.Key)
+}
+
+// quietHoursFor returns the quiet hours of the subscription, nil if it has none
+func (c *Client) quietHoursFor(s her.SubscriptionConf) (*quiet.Schedule, error) {
+	if s.QuietHours == nil {
+		return c.quietHours, nil
+	}
+
+	c.cacheMu.Lock()
+	defer c.cacheMu.Unlock()
+
+	if schedule, ok := c.quietCache[*s.QuietHours]; ok {
+		return schedule, nil
+	}
+	schedule, err := quiet.Compile(*s.QuietHours)
+	if err != nil {
+		return nil, fmt.Errorf("subscription %s: %w", s.Topic, err)
+	}
+	if c.quietCache == nil {
+		c.quietCache = make(map[her.QuietHoursConf]*quiet.Schedule)
+	}
+	c.quietCache[*s.QuietHours] = schedule
+	return schedule, nil
+}
+
+// hold keeps the message until the quiet hours end. A value notification replaces the previous one
+// of the same subscription and key
+func (c *Client) hold(h heldMessage) {
+	c.heldMu.Lock()
+	defer c.heldMu.Unlock()
+
+	if h.replace {
+		for i, old := range c.held {
+			if old.replace && old.subscription == h.subscription && old.key == h.key {
+				c.held[i] = h
+				return
+			}
+		}
+	}
+	if len(c.held) >= maxHeld {
+		log.Warningf("Too many messages held for the quiet hours, dropping: %s", c.held[0].msg.Text)
+		c.held = append(c.held[:0], c.held[1:]...)
+	}
+	c.held = append(c.held, h)
+}
+
+// releaseHeld sends a summary of the messages whose quiet hours have ended, one for each chat and
+// split in more messages if too long. A message repeated right after itself is summarized once
+func (c *Client) releaseHeld(now time.Time) {
+	c.heldMu.Lock()
+	var due []her.Message
+	held := c.held[:0]
+	for _, h := range c.held {
+		if h.release.After(now) {
+			held = append(held, h)
+			continue
+		}
+		due = append(due, h.msg)
+	}
+	c.held = held
+	c.heldMu.Unlock()
+
+	var chats []int64
+	texts := make(map[int64][]string)
+	for _, msg := range due {
+		previous, ok := texts[msg.ChatID]
+		if !ok {
+			chats = append(chats, msg.ChatID)
+		}
+		if len(previous) > 0 && previous[len(previous)-1] == msg.Text {
+			continue
+		}
+		texts[msg.ChatID] = append(previous, msg.Text)
+	}
+
+	for _, chat := range chats {
+		for _, text := range summaries(texts[chat]) {
+			log.Info(text)
+			c.send(her.Message{Topic: "quiet_hours", Message: []byte(text), Text: text, ChatID: chat})
+		}
+	}
+}
+
+// summaries joins the held messages in as few summaries as possible within summaryLimit. Messages
+// too long even alone are truncated
+func summaries(texts []string) []string {
+	const header = "While in quiet hours:"
+	var summaries []string
+	var b strings.Builder
+	for _, text := range texts {
+		if max := summaryLimit - len(header) - 1; len(text) > max {
+			text = strings.ToValidUTF8(text[:max-len("…")], "") + "…"
+		}
+		if b.Len() > 0 && b.Len()+1+len(text) > summaryLimit {
+			summaries = append(summaries, b.String())
+			b.Reset()
+		}
+		if b.Len() == 0 {
+			b.WriteString(header)
+		}
+		b.WriteString("\n" + text)
+	}
+	if b.Len() > 0 {
+		summaries = append(summaries, b.String())
+	}
+	return summaries
+}
@@ -0,0 +1,159 @@
+package mqtt
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tommyblue/her/her"
+	"github.com/tommyblue/her/notify"
+	"github.com/tommyblue/her/quiet"
+	"github.com/tommyblue/her/state"
+)
+
+func TestQuietHours(t *testing.T) {
+	// Quiet hours around now
+	now := time.Now()
+	schedule, err := quiet.Compile(her.QuietHoursConf{
+		Start: now.Add(-time.Hour).Format("15:04"),
+		End:   now.Add(time.Hour).Format("15:04"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outCh := make(chan her.Message, 10)
+	client := &Client{
+		outCh:      outCh,
+		store:      state.NewStore(),
+		quietHours: schedule,
+		subscriptions: []her.SubscriptionConf{
+			{
+				Label:  "Kitchen",
+				Topic:  "kitchen/temperature",
+				Repeat: true,
+				Alarm:  &her.AlarmConf{Operator: "greater_than", Value: 25},
+			},
+			{
+				Label: "Bathroom",
+				Topic: "bathroom/leak",
+				Alarm: &her.AlarmConf{Operator: "equals", Text: "wet", Severity: her.SeverityCritical},
+			},
+			{
+				Label:  "Garden",
+				Topic:  "garden/temperature",
+				Repeat: true,
+				QuietHours: &her.QuietHoursConf{
+					Start: now.Add(2 * time.Hour).Format("15:04"),
+					End:   now.Add(3 * time.Hour).Format("15:04"),
+				},
+			},
+		},
+	}
+	send := func(topic, v string) {
+		client.msgCallback(nil, mqttMessageMock{topic: topic, payload: []byte(v)})
+	}
+
+	send("kitchen/temperature", "21")
+	send("kitchen/temperature", "30")
+	send("bathroom/leak", "wet")
+	if msg := <-outCh; msg.Text != "[bathroom/leak] Alarm: Bathroom value is wet" {
+		t.Errorf("Critical alarms must be sent immediately, got %q", msg.Text)
+	}
+	if len(outCh) != 0 {
+		t.Fatalf("Unexpected message %q", (<-outCh).Text)
+	}
+
+	// Subscriptions can override the global quiet hours
+	send("garden/temperature", "12")
+	if msg := <-outCh; msg.Text != "[garden/temperature] 12" {
+		t.Errorf("unexpected message %q", msg.Text)
+	}
+
+	client.releaseHeld(now)
+	if len(outCh) != 0 {
+		t.Fatalf("Unexpected message %q", (<-outCh).Text)
+	}
+	client.releaseHeld(now.Add(2 * time.Hour))
+	want := "While in quiet hours:\n" +
+		"[kitchen/temperature] 30\n" +
+		"[kitchen/temperature] Alarm: Kitchen value is 30"
+	if msg := <-outCh; msg.Text != want {
+		t.Errorf("want: %q, got: %q", want, msg.Text)
+	}
+	if len(client.held) != 0 {
+		t.Errorf("Messages still held: %v", client.held)
+	}
+}
+
+func TestQuietHoursAlarmCleared(t *testing.T) {
+	now := time.Now()
+	schedule, err := quiet.Compile(her.QuietHoursConf{
+		Start: now.Add(-time.Hour).Format("15:04"),
+		End:   now.Add(time.Hour).Format("15:04"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outCh := make(chan her.Message, 10)
+	client := &Client{
+		outCh:      outCh,
+		store:      state.NewStore(),
+		quietHours: schedule,
+		subscriptions: []her.SubscriptionConf{{
+			Label:  "Kitchen",
+			Topic:  "kitchen/temperature",
+			Repeat: true,
+			Alarm:  &her.AlarmConf{Operator: "greater_than", Value: 25},
+		}},
+	}
+	send := func(v string) {
+		client.msgCallback(nil, mqttMessageMock{topic: "kitchen/temperature", payload: []byte(v)})
+	}
+
+	// Fired and cleared twice, then silent
+	send("30")
+	send("20")
+	send("30")
+	send("20")
+	s := client.subscriptions[0]
+	s.MaxSilence = time.Minute
+	if msg, ok := client.silence(s, "kitchen/temperature", "Kitchen", now.Add(-time.Hour), now); ok {
+		client.deliver(s, notify.Data{Key: "kitchen/temperature"}, msg, "", false)
+	}
+	if len(outCh) != 0 {
+		t.Fatalf("Unexpected message %q", (<-outCh).Text)
+	}
+
+	client.releaseHeld(now.Add(2 * time.Hour))
+	want := "While in quiet hours:\n" +
+		"[kitchen/temperature] 20\n" +
+		"[kitchen/temperature] Alarm: Kitchen value is 30\n" +
+		"[kitchen/temperature] Back to normal: Kitchen value is 20\n" +
+		"[kitchen/temperature] Alarm: Kitchen value is 30\n" +
+		"[kitchen/temperature] Back to normal: Kitchen value is 20\n" +
+		"[kitchen/temperature] Kitchen has not reported for 1h0m0s"
+	if msg := <-outCh; msg.Text != want {
+		t.Errorf("want: %q, got: %q", want, msg.Text)
+	}
+}
+
+func TestSummaries(t *testing.T) {
+	line := strings.Repeat("x", 1000)
+	got := summaries([]string{line, line, line, line, line, strings.Repeat("y", 5000)})
+	if len(got) != 3 {
+		t.Fatalf("want 3 summaries, got %d", len(got))
+	}
+	for _, s := range got {
+		if len(s) > summaryLimit || !strings.HasPrefix(s, "While in quiet hours:\n") {
+			t.Errorf("invalid summary of %d bytes starting with %q", len(s), s[:30])
+		}
+	}
+	if strings.Count(got[0], line) != 4 || strings.Count(got[1], line) != 1 {
+		t.Errorf("unexpected split %d, %d", strings.Count(got[0], line), strings.Count(got[1], line))
+	}
+	if !strings.HasSuffix(got[2], "y…") {
+		t.Error("Messages too long must be truncated")
+	}
+}
@@ -0,0 +1,94 @@
+package mqtt
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/spf13/viper"
+)
+
+// newTLSConfig builds the TLS configuration from the mqtt section of the config. It returns nil
+// when no TLS option is set, so that paho uses its defaults for ssl:// and tls:// brokers
+func newTLSConfig() (*tls.Config, error) {
+	caFile := viper.GetString("mqtt.ca_file")
+	certFile := viper.GetString("mqtt.client_cert")
+	keyFile := viper.GetString("mqtt.client_key")
+	insecure := viper.GetBool("mqtt.insecure_skip_verify")
+
+	if caFile == "" && certFile == "" && keyFile == "" && !insecure {
+		return nil, nil
+	}
+
+	conf := &tls.Config{
+		InsecureSkipVerify: insecure,
+	}
+
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("mqtt TLS: cannot read the CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("mqtt TLS: no valid certificate found in the CA file %s", caFile)
+		}
+		conf.RootCAs = pool
+	}
+
+	if (certFile == "") != (keyFile == "") {
+		return nil, errors.New("mqtt TLS: client_cert and client_key must be set together")
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("mqtt TLS: cannot load the client certificate: %w", err)
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+
+	return conf, nil
+}
+
+// tlsSchemes are the broker URL schemes paho connects to with TLS
+var tlsSchemes = map[string]bool{"ssl": true, "tls": true, "mqtts": true, "mqtt+ssl": true, "tcp+ssl": true, "tcps": true}
+
+// dialTLS opens the TLS connection to the broker like paho does without a proxy, keeping the
+// error for connectError, as paho flattens it to a string
+func (c *Client) dialTLS(uri *url.URL, options MQTT.ClientOptions) (net.Conn, error) {
+	dialer := options.Dialer
+	if dialer == nil {
+		dialer = &net.Dialer{Timeout: options.ConnectTimeout}
+	}
+	conn, err := tls.DialWithDialer(dialer, "tcp", uri.Host, options.TLSConfig)
+
+	c.dialMu.Lock()
+	c.dialErr = err
+	c.dialMu.Unlock()
+	return conn, err
+}
+
+// connectError makes explicit whether the connection to the broker failed because of the
+// authentication or the TLS handshake. dialErr is the error of the last TLS connection, if any
+func connectError(err, dialErr error) error {
+	for _, code := range []byte{packets.ErrRefusedBadUsernameOrPassword, packets.ErrRefusedNotAuthorised} {
+		if errors.Is(err, packets.ConnErrors[code]) {
+			return fmt.Errorf("mqtt authentication failed: %w", err)
+		}
+	}
+	if dialErr == nil {
+		return err
+	}
+	// Failing to reach the broker is not a TLS problem
+	var opErr *net.OpError
+	if errors.As(dialErr, &opErr) && opErr.Op == "dial" {
+		return err
+	}
+	return fmt.Errorf("mqtt TLS handshake failed: %w", dialErr)
+}
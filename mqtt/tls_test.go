@@ -0,0 +1,172 @@
+package mqtt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/spf13/viper"
+)
+
+// writeCertificate writes a self-signed certificate and its key in dir, returning their paths
+func writeCertificate(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "her"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeCertificate(t, dir)
+	invalidFile := filepath.Join(dir, "invalid.pem")
+	if err := os.WriteFile(invalidFile, []byte("invalid"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	reset := func() {
+		for _, k := range []string{"mqtt.ca_file", "mqtt.client_cert", "mqtt.client_key", "mqtt.insecure_skip_verify"} {
+			viper.Set(k, nil)
+		}
+	}
+	defer reset()
+
+	t.Run("Without TLS options", func(t *testing.T) {
+		reset()
+		conf, err := newTLSConfig()
+		if err != nil || conf != nil {
+			t.Errorf("Expected no TLS config, got %v, %v", conf, err)
+		}
+	})
+	t.Run("With CA and client certificate", func(t *testing.T) {
+		reset()
+		viper.Set("mqtt.ca_file", certFile)
+		viper.Set("mqtt.client_cert", certFile)
+		viper.Set("mqtt.client_key", keyFile)
+		conf, err := newTLSConfig()
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		if conf.RootCAs == nil || len(conf.Certificates) != 1 {
+			t.Errorf("CA or client certificate not loaded")
+		}
+	})
+	t.Run("With insecure skip verify", func(t *testing.T) {
+		reset()
+		viper.Set("mqtt.insecure_skip_verify", true)
+		conf, err := newTLSConfig()
+		if err != nil || !conf.InsecureSkipVerify {
+			t.Errorf("Expected insecure config, got %v, %v", conf, err)
+		}
+	})
+	t.Run("With missing CA file", func(t *testing.T) {
+		reset()
+		viper.Set("mqtt.ca_file", filepath.Join(dir, "missing.pem"))
+		if _, err := newTLSConfig(); err == nil || !strings.HasPrefix(err.Error(), "mqtt TLS:") {
+			t.Errorf("Expected TLS error, got %v", err)
+		}
+	})
+	t.Run("With invalid CA file", func(t *testing.T) {
+		reset()
+		viper.Set("mqtt.ca_file", invalidFile)
+		if _, err := newTLSConfig(); err == nil {
+			t.Errorf("Expected error")
+		}
+	})
+	t.Run("With client certificate but no key", func(t *testing.T) {
+		reset()
+		viper.Set("mqtt.client_cert", certFile)
+		if _, err := newTLSConfig(); err == nil {
+			t.Errorf("Expected error")
+		}
+	})
+}
+
+func TestConnectError(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	tests := []struct {
+		err     error
+		dialErr error
+		want    string
+	}{
+		{packets.ErrorRefusedBadUsernameOrPassword, nil, "mqtt authentication failed: bad user name or password"},
+		{packets.ErrorRefusedNotAuthorised, nil, "mqtt authentication failed: not Authorized"},
+		{errors.New("network Error : tls: handshake failure"), x509.UnknownAuthorityError{}, "mqtt TLS handshake failed: x509: certificate signed by unknown authority"},
+		{errors.New("network Error : dial tcp: connection refused"), refused, "network Error : dial tcp: connection refused"},
+		{errors.New("network Error : dial tcp: connection refused"), nil, "network Error : dial tcp: connection refused"},
+	}
+
+	for _, tt := range tests {
+		if got := connectError(tt.err, tt.dialErr); got.Error() != tt.want {
+			t.Errorf("connectError() = %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestDialTLS(t *testing.T) {
+	// A broker not speaking TLS
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		conn.Write([]byte("HTTP/1.0 400 Bad Request\r\n\r\n"))
+		conn.Close()
+	}()
+
+	c := &Client{}
+	uri, _ := url.Parse("ssl://" + l.Addr().String())
+	if _, err := c.dialTLS(uri, *MQTT.NewClientOptions()); err == nil {
+		t.Fatal("Expected error")
+	}
+	var recordErr tls.RecordHeaderError
+	if err := connectError(errors.New("network Error"), c.dialErr); !errors.As(err, &recordErr) || !strings.HasPrefix(err.Error(), "mqtt TLS handshake failed") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
@@ -0,0 +1,128 @@
+package mqtt
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/tommyblue/her/her"
+	"github.com/tommyblue/her/notify"
+)
+
+// watchdogInterval is how often the subscriptions with a max_silence are checked
+const watchdogInterval = 10 * time.Second
+
+// startWatchdog checks periodically that the subscriptions with a max_silence keep reporting, and
+// sends the summary of the messages held back when the quiet hours end
+func (c *Client) startWatchdog() {
+	stop := make(chan struct{})
+	c.silenceMu.Lock()
+	c.watchdogSince = time.Now()
+	c.watchdogStop = stop
+	c.silenceMu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(watchdogInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				c.watchSilence(now)
+				c.releaseHeld(now)
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+func (c *Client) stopWatchdog() {
+	c.silenceMu.Lock()
+	defer c.silenceMu.Unlock()
+
+	if c.watchdogStop != nil {
+		close(c.watchdogStop)
+		c.watchdogStop = nil
+	}
+}
+
+// watchSilence alerts about the topics that haven't reported within their max_silence. Values
+// received before the watchdog started count as received when it started, not to alert about
+// the time her was down. Topics without wildcards are watched even if they never reported
+func (c *Client) watchSilence(now time.Time) {
+	c.subsMu.RLock()
+	subscriptions := append([]her.SubscriptionConf(nil), c.subscriptions...)
+	c.subsMu.RUnlock()
+	entries := c.store.Snapshot()
+
+	type alert struct {
+		subscription her.SubscriptionConf
+		data         notify.Data
+		msg          her.Message
+	}
+	var alerts []alert
+	c.silenceMu.Lock()
+	for _, s := range subscriptions {
+		if s.MaxSilence <= 0 {
+			continue
+		}
+		reported := false
+		for _, e := range entries {
+			if !her.TopicMatches(s.Topic, e.Topic) || s.StateKey(e.Topic) != e.Key {
+				continue
+			}
+			reported = true
+			if msg, ok := c.silence(s, e.Key, e.Label, e.ReceivedAt, now); ok {
+				alerts = append(alerts, alert{s, notify.Data{Key: e.Key, Topic: e.Topic}, msg})
+			}
+		}
+		if !reported && !her.IsWildcard(s.Topic) {
+			key := s.StateKey(s.Topic)
+			if msg, ok := c.silence(s, key, s.LabelFor(s.Topic), time.Time{}, now); ok {
+				alerts = append(alerts, alert{s, notify.Data{Key: key, Topic: s.Topic}, msg})
+			}
+		}
+	}
+	c.silenceMu.Unlock()
+
+	for _, a := range alerts {
+		c.deliver(a.subscription, a.data, a.msg, "", false)
+	}
+}
+
+// silence marks the key as silent if it didn't report since last, returning the alert the first
+// time. It must be called holding silenceMu
+func (c *Client) silence(s her.SubscriptionConf, key, label string, last, now time.Time) (her.Message, bool) {
+	if last.Before(c.watchdogSince) {
+		last = c.watchdogSince
+	}
+	if c.silent[key] || now.Sub(last) <= s.MaxSilence {
+		return her.Message{}, false
+	}
+
+	if c.silent == nil {
+		c.silent = make(map[string]bool)
+	}
+	c.silent[key] = true
+	c.store.MarkStale(key, last)
+
+	text := fmt.Sprintf("[%s] %s has not reported for %s", key, label, now.Sub(last).Truncate(time.Second))
+	return her.Message{Topic: key, Message: []byte(text), Text: text}, true
+}
+
+// checkSilence notifies that the key reports again after being silent
+func (c *Client) checkSilence(s her.SubscriptionConf, data notify.Data) {
+	key := data.Key
+	c.silenceMu.Lock()
+	silent := c.silent[key]
+	delete(c.silent, key)
+	c.silenceMu.Unlock()
+	if !silent {
+		return
+	}
+
+	text := fmt.Sprintf("[%s] %s is reporting again: %s", key, data.Label, data.Value)
+	if data.Unit != "" {
+		text += " " + data.Unit
+	}
+	c.deliver(s, data, her.Message{Topic: key, Message: []byte(text), Text: text}, "", false)
+}
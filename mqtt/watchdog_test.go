@@ -0,0 +1,75 @@
+package mqtt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tommyblue/her/her"
+	"github.com/tommyblue/her/state"
+)
+
+func TestWatchSilence(t *testing.T) {
+	outCh := make(chan her.Message, 10)
+	start := time.Now()
+	client := &Client{
+		outCh:         outCh,
+		store:         state.NewStore(),
+		watchdogSince: start,
+		subscriptions: []her.SubscriptionConf{
+			{Label: "Bathroom", Topic: "bathroom/temperature", MaxSilence: time.Hour},
+			{Label: "Window", Topic: "window/+", MaxSilence: 2 * time.Hour},
+			{Label: "Kitchen", Topic: "kitchen/temperature"},
+		},
+	}
+	client.msgCallback(nil, mqttMessageMock{topic: "window/kitchen", payload: []byte("closed")})
+	client.msgCallback(nil, mqttMessageMock{topic: "kitchen/temperature", payload: []byte("21")})
+	for len(outCh) > 0 {
+		<-outCh
+	}
+
+	client.watchSilence(start.Add(30 * time.Minute))
+	if len(outCh) != 0 {
+		t.Fatalf("Unexpected alert %q", (<-outCh).Text)
+	}
+
+	// Never reported since her started
+	client.watchSilence(start.Add(90 * time.Minute))
+	if msg := <-outCh; msg.Text != "[bathroom/temperature] Bathroom has not reported for 1h30m0s" {
+		t.Errorf("unexpected alert %q", msg.Text)
+	}
+	client.watchSilence(start.Add(100 * time.Minute))
+	if len(outCh) != 0 {
+		t.Fatalf("The alert must be sent once, got %q", (<-outCh).Text)
+	}
+
+	// Silent wildcard topics are marked stale
+	client.watchSilence(start.Add(3 * time.Hour))
+	if msg := <-outCh; msg.Topic != "window/kitchen" {
+		t.Errorf("unexpected alert %q", msg.Text)
+	}
+	if e, _ := client.store.Get("window/kitchen"); !e.Stale() {
+		t.Error("Silent value must be stale")
+	}
+	if len(outCh) != 0 {
+		t.Fatalf("Unexpected alert %q", (<-outCh).Text)
+	}
+
+	// Reporting again
+	client.msgCallback(nil, mqttMessageMock{topic: "window/kitchen", payload: []byte("open")})
+	if msg := <-outCh; msg.Text != "[window/kitchen] Window (window/kitchen) is reporting again: open" {
+		t.Errorf("unexpected message %q", msg.Text)
+	}
+	if e, _ := client.store.Get("window/kitchen"); e.Stale() {
+		t.Error("Fresh value must not be stale")
+	}
+}
+
+func TestStopWatchdog(t *testing.T) {
+	client := &Client{store: state.NewStore()}
+	client.startWatchdog()
+	client.stopWatchdog()
+	client.stopWatchdog()
+	if client.watchdogStop != nil {
+		t.Error("Watchdog not stopped")
+	}
+}
@@ -0,0 +1,147 @@
+// Package notify formats the notifications sent to the bot using text/template
+package notify
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/tommyblue/her/alarm"
+	"github.com/tommyblue/her/her"
+)
+
+// Default templates. Alarms show the value formatted as the other messages, .Alarm.Value has the number
+const (
+	DefaultNotification = "[{{.Key}}] {{.Value}}{{with .Unit}} {{.}}{{end}}"
+	DefaultAlarm        = `[{{.Key}}] {{if .Alarm.Repeat}}Reminder, alarm{{else}}Alarm{{end}}: {{.Label}} value is {{.Value}}{{with .Unit}} {{.}}{{end}}{{if .Alarm.Window}} ({{printf "%+.2f" .Alarm.Change}} in {{.Alarm.Window}}){{end}}`
+	DefaultRecovery     = "[{{.Key}}] Back to normal: {{.Label}} value is {{.Value}}{{with .Unit}} {{.}}{{end}}"
+	DefaultStatus       = "{{.Label}}: {{.Value}}{{with .Unit}} {{.}}{{end}}{{with .Severity}} ({{.}}){{end}}"
+)
+
+// Data is what templates can access
+type Data struct {
+	Key       string // State key, the topic followed by the JSON path if any
+	Label     string
+	Topic     string
+	Value     string // Formatted with the values map and precision of the subscription
+	Raw       string // Value as received
+	Previous  string // Empty for the first value
+	Unit      string
+	Timestamp time.Time
+	Alarm     Alarm  // The alarm being notified or, in the status line, the most severe one
+	Severity  string // Worst severity among the active alarms, empty if none is active
+}
+
+// Alarm describes the alarm of the subscription
+type Alarm struct {
+	Name      string
+	Severity  string
+	Active    bool
+	Operator  string
+	Threshold float64
+	Min       float64 // Range of the between and outside operators
+	Max       float64
+	Text      string        // Text of the string operators
+	For       time.Duration // How long the condition must last
+	Value     float64       // Numeric value that triggered the alarm, not rounded, zero for string operators
+	Window    time.Duration // Period of rises_by and falls_by
+	Change    float64       // Change of the value over the window, negative when it falls
+	// TriggeredAt is when the alarm was last triggered, to tell for how long it lasted once cleared
+	TriggeredAt time.Time
+	Repeat      int // How many times a sticky alarm has been notified again
+}
+
+// Numeric reports whether the alarm compares numbers
+func (a Alarm) Numeric() bool {
+	return alarm.NumericOperator(a.Operator)
+}
+
+// Trend compares the numeric value to the previous one, returning "rose", "fell" or "changed"
+func (d Data) Trend() string {
+	v, err1 := strconv.ParseFloat(d.Value, 64)
+	p, err2 := strconv.ParseFloat(d.Previous, 64)
+	switch {
+	case err1 != nil || err2 != nil:
+		return "changed"
+	case v > p:
+		return "rose"
+	case v < p:
+		return "fell"
+	}
+	return "changed"
+}
+
+// Set is a compiled set of templates
+type Set struct {
+	notification *template.Template
+	alarm        *template.Template
+	recovery     *template.Template
+	status       *template.Template
+}
+
+// Compile parses the templates. The missing ones are inherited from the fallback set or, without
+// a fallback, from the defaults
+func Compile(conf her.TemplatesConf, fallback *Set) (*Set, error) {
+	if fallback == nil {
+		fallback = &Set{}
+	}
+	var err error
+	s := &Set{}
+	if s.notification, err = parse("notification", conf.Notification, DefaultNotification, fallback.notification); err != nil {
+		return nil, err
+	}
+	if s.alarm, err = parse("alarm", conf.Alarm, DefaultAlarm, fallback.alarm); err != nil {
+		return nil, err
+	}
+	if s.recovery, err = parse("recovery", conf.Recovery, DefaultRecovery, fallback.recovery); err != nil {
+		return nil, err
+	}
+	if s.status, err = parse("status", conf.Status, DefaultStatus, fallback.status); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func parse(name, text, def string, fallback *template.Template) (*template.Template, error) {
+	if text == "" && fallback != nil {
+		return fallback, nil
+	}
+	if text == "" {
+		text = def
+	}
+	t, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s template: %w", name, err)
+	}
+	return t, nil
+}
+
+// Notification formats the message sent when a value is received
+func (s *Set) Notification(d Data) (string, error) {
+	return execute(s.notification, d)
+}
+
+// Alarm formats the message sent when an alarm is triggered
+func (s *Set) Alarm(d Data) (string, error) {
+	return execute(s.alarm, d)
+}
+
+// Recovery formats the message sent when an alarm is cleared
+func (s *Set) Recovery(d Data) (string, error) {
+	return execute(s.recovery, d)
+}
+
+// Status formats the line of the value in the /status reply
+func (s *Set) Status(d Data) (string, error) {
+	return execute(s.status, d)
+}
+
+func execute(t *template.Template, d Data) (string, error) {
+	var sb strings.Builder
+	if err := t.Execute(&sb, d); err != nil {
+		return "", fmt.Errorf("cannot execute the %s template: %w", t.Name(), err)
+	}
+	return sb.String(), nil
+}
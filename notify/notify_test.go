@@ -0,0 +1,87 @@
+package notify
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tommyblue/her/her"
+)
+
+func TestCompile(t *testing.T) {
+	global, err := Compile(her.TemplatesConf{Status: "{{.Label}} = {{.Value}} {{.Unit}}"}, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	sub, err := Compile(her.TemplatesConf{
+		Notification: "{{.Label}} {{.Trend}} to {{.Value}} {{.Unit}}{{with .Previous}} (was {{.}}){{end}}",
+	}, global)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	data := Data{
+		Key:       "sensor/temperature",
+		Label:     "Kitchen temperature",
+		Topic:     "sensor/temperature",
+		Value:     "23.4",
+		Previous:  "21.0",
+		Unit:      "°C",
+		Timestamp: time.Date(2020, 1, 2, 15, 4, 0, 0, time.UTC),
+		Alarm:     Alarm{Active: true, Operator: "greater_than", Threshold: 20, Value: 23.4},
+	}
+	tests := []struct {
+		name   string
+		render func(Data) (string, error)
+		want   string
+	}{
+		{"default notification", global.Notification, "[sensor/temperature] 23.4 °C"},
+		{"default alarm", global.Alarm, "[sensor/temperature] Alarm: Kitchen temperature value is 23.4 °C"},
+		{"default recovery", global.Recovery, "[sensor/temperature] Back to normal: Kitchen temperature value is 23.4 °C"},
+		{"global status", global.Status, "Kitchen temperature = 23.4 °C"},
+		{"subscription notification", sub.Notification, "Kitchen temperature rose to 23.4 °C (was 21.0)"},
+		{"inherited status", sub.Status, "Kitchen temperature = 23.4 °C"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.render(data)
+			if err != nil {
+				t.Fatalf("Unexpected error %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	if _, err := Compile(her.TemplatesConf{Alarm: "{{.Label"}, nil); err == nil {
+		t.Error("Expected a parse error")
+	}
+
+	s, err := Compile(her.TemplatesConf{Notification: "{{.Missing}}"}, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if _, err := s.Notification(Data{}); err == nil {
+		t.Error("Expected an execution error")
+	}
+}
+
+func TestTrend(t *testing.T) {
+	tests := []struct {
+		value, previous string
+		want            string
+	}{
+		{"23.4", "21", "rose"},
+		{"19", "21", "fell"},
+		{"21", "21", "changed"},
+		{"ON", "OFF", "changed"},
+		{"21", "", "changed"},
+	}
+	for _, tt := range tests {
+		if got := (Data{Value: tt.value, Previous: tt.previous}).Trend(); got != tt.want {
+			t.Errorf("Trend(%q, %q) = %q, want %q", tt.value, tt.previous, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+// Package quiet tells when the notifications must be held back for the quiet hours
+package quiet
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/tommyblue/her/her"
+)
+
+// Schedule is a validated quiet hours configuration
+type Schedule struct {
+	start, end clock
+	loc        *time.Location
+	bypass     string
+}
+
+// Compile validates the quiet hours configuration
+func Compile(conf her.QuietHoursConf) (*Schedule, error) {
+	s := &Schedule{loc: time.Local, bypass: conf.Bypass}
+	var err error
+	if s.start, err = parseClock(conf.Start); err != nil {
+		return nil, fmt.Errorf("quiet hours start: %w", err)
+	}
+	if s.end, err = parseClock(conf.End); err != nil {
+		return nil, fmt.Errorf("quiet hours end: %w", err)
+	}
+	if s.start == s.end {
+		return nil, fmt.Errorf("quiet hours start and end are both %s", conf.Start)
+	}
+	if conf.Timezone != "" {
+		if s.loc, err = time.LoadLocation(conf.Timezone); err != nil {
+			return nil, fmt.Errorf("quiet hours timezone: %w", err)
+		}
+	}
+	if s.bypass == "" {
+		s.bypass = her.SeverityCritical
+	}
+	if her.SeverityRank(s.bypass) < 0 {
+		return nil, fmt.Errorf("quiet hours: unknown bypass severity %s", s.bypass)
+	}
+	return s, nil
+}
+
+// clock is a time of the day. It's kept as hours and minutes, not as the time since midnight,
+// which differs on the days the clocks change
+type clock struct {
+	hour, minute int
+}
+
+// parseClock returns the time of the day written as 15:04
+func parseClock(value string) (clock, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return clock{}, fmt.Errorf("invalid time %q, expected hh:mm", value)
+	}
+	return clock{hour: t.Hour(), minute: t.Minute()}, nil
+}
+
+// minutes returns the minutes since 00:00
+func (c clock) minutes() int {
+	return c.hour*60 + c.minute
+}
+
+// Active reports whether t falls in the quiet hours. They can span midnight, like 22:00 to 07:00
+func (s *Schedule) Active(t time.Time) bool {
+	t = t.In(s.loc)
+	now := clock{hour: t.Hour(), minute: t.Minute()}.minutes()
+	start, end := s.start.minutes(), s.end.minutes()
+	if start < end {
+		return now >= start && now < end
+	}
+	return now >= start || now < end
+}
+
+// End returns when the quiet hours including t end
+func (s *Schedule) End(t time.Time) time.Time {
+	t = t.In(s.loc)
+	end := time.Date(t.Year(), t.Month(), t.Day(), s.end.hour, s.end.minute, 0, 0, s.loc)
+	if !end.After(t) {
+		end = time.Date(t.Year(), t.Month(), t.Day()+1, s.end.hour, s.end.minute, 0, 0, s.loc)
+	}
+	return end
+}
+
+// Bypass reports whether the alarms of the severity are sent even during the quiet hours.
+// Notifications, having no severity, never are
+func (s *Schedule) Bypass(severity string) bool {
+	return severity != "" && her.SeverityRank(severity) >= her.SeverityRank(s.bypass)
+}
@@ -0,0 +1,84 @@
+package quiet
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tommyblue/her/her"
+)
+
+func TestCompile(t *testing.T) {
+	tests := []struct {
+		name string
+		conf her.QuietHoursConf
+	}{
+		{"missing start", her.QuietHoursConf{End: "07:00"}},
+		{"invalid end", her.QuietHoursConf{Start: "22:00", End: "7am"}},
+		{"empty", her.QuietHoursConf{Start: "22:00", End: "22:00"}},
+		{"unknown timezone", her.QuietHoursConf{Start: "22:00", End: "07:00", Timezone: "Mars/Olympus"}},
+		{"unknown severity", her.QuietHoursConf{Start: "22:00", End: "07:00", Bypass: "fatal"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Compile(tt.conf); err == nil {
+				t.Error("Expected error")
+			}
+		})
+	}
+}
+
+func TestActive(t *testing.T) {
+	rome, err := time.LoadLocation("Europe/Rome")
+	if err != nil {
+		t.Skip(err)
+	}
+	night, err := Compile(her.QuietHoursConf{Start: "22:00", End: "07:00", Timezone: "Europe/Rome"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lunch, err := Compile(her.QuietHoursConf{Start: "13:00", End: "14:30", Timezone: "Europe/Rome"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		schedule *Schedule
+		at       time.Time
+		want     bool
+		end      time.Time
+	}{
+		{night, time.Date(2023, 1, 1, 23, 0, 0, 0, rome), true, time.Date(2023, 1, 2, 7, 0, 0, 0, rome)},
+		{night, time.Date(2023, 1, 2, 3, 0, 0, 0, rome), true, time.Date(2023, 1, 2, 7, 0, 0, 0, rome)},
+		{night, time.Date(2023, 1, 2, 7, 0, 0, 0, rome), false, time.Date(2023, 1, 3, 7, 0, 0, 0, rome)},
+		// 02:00 UTC is 03:00 in Rome
+		{night, time.Date(2023, 1, 2, 2, 0, 0, 0, time.UTC), true, time.Date(2023, 1, 2, 7, 0, 0, 0, rome)},
+		{lunch, time.Date(2023, 1, 1, 14, 29, 0, 0, rome), true, time.Date(2023, 1, 1, 14, 30, 0, 0, rome)},
+		{lunch, time.Date(2023, 1, 1, 12, 59, 0, 0, rome), false, time.Date(2023, 1, 1, 14, 30, 0, 0, rome)},
+		// The clocks change at 02:00 on the last Sunday of March and October
+		{night, time.Date(2023, 3, 26, 1, 0, 0, 0, rome), true, time.Date(2023, 3, 26, 7, 0, 0, 0, rome)},
+		{night, time.Date(2023, 10, 29, 1, 0, 0, 0, rome), true, time.Date(2023, 10, 29, 7, 0, 0, 0, rome)},
+	}
+	for _, tt := range tests {
+		if got := tt.schedule.Active(tt.at); got != tt.want {
+			t.Errorf("Active(%v) = %v, want %v", tt.at, got, tt.want)
+		}
+		if got := tt.schedule.End(tt.at); !got.Equal(tt.end) {
+			t.Errorf("End(%v) = %v, want %v", tt.at, got, tt.end)
+		}
+	}
+}
+
+func TestBypass(t *testing.T) {
+	s, err := Compile(her.QuietHoursConf{Start: "22:00", End: "07:00"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Bypass(her.SeverityCritical) || s.Bypass(her.SeverityWarning) || s.Bypass("") {
+		t.Error("Only critical alarms must bypass the quiet hours by default")
+	}
+
+	s, _ = Compile(her.QuietHoursConf{Start: "22:00", End: "07:00", Bypass: her.SeverityWarning})
+	if !s.Bypass(her.SeverityCritical) || !s.Bypass(her.SeverityWarning) || s.Bypass(her.SeverityInfo) {
+		t.Error("Alarms of the bypass severity or worse must bypass the quiet hours")
+	}
+}
@@ -0,0 +1,428 @@
+// Package rules runs actions, like publishing to MQTT or notifying the bot, when values are received,
+// alarms are triggered or at times of the day
+package rules
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tommyblue/her/alarm"
+	"github.com/tommyblue/her/her"
+	"github.com/tommyblue/her/state"
+)
+
+// A rule running more than loopRuns times within loopWindow, e.g. two rules switching each other's
+// device, is suspended for loopWindow
+const (
+	loopRuns   = 10
+	loopWindow = time.Minute
+)
+
+// echoWindow is how long a rule ignores the values of the topics it published, as they're likely
+// the echo of its own messages
+const echoWindow = 5 * time.Second
+
+// resultTimeout is how long to wait for the outcome of a command
+const resultTimeout = 15 * time.Second
+
+// Publisher is the part of the MQTT client used by the rules. Like the commands of the bot, the
+// messages are queued while the broker is unreachable
+type Publisher interface {
+	PublishOrQueue(her.Message) her.PublishResult
+}
+
+// Data is what the notify templates of the rules can use
+type Data struct {
+	Rule  string
+	Key   string // State key of the value or the alarm, empty for the times of the day
+	Value string
+	Alarm string
+	Time  time.Time
+}
+
+// rule is a validated rule and its state
+type rule struct {
+	conf     her.RuleConf
+	triggers []*trigger
+	when     *alarm.Expr
+	notify   map[int]*template.Template // By action index
+
+	mu             sync.Mutex
+	runs           []time.Time // Recent runs, for the loop protection
+	suspendedUntil time.Time
+	published      map[string]time.Time // Topics published by the rule, not to be triggered by them
+}
+
+// Engine runs the rules
+type Engine struct {
+	publisher  Publisher
+	store      *state.Store
+	commandsCh chan<- her.Message // Read by the MQTT client, like the commands of the bot
+	botCh      chan<- her.Message
+	commands   map[string]her.CommandConf
+	rules      []*rule
+	mu         sync.RWMutex // Guards timers and the start of the runs against Stop
+	timers     map[*trigger]*time.Timer
+	stop       chan struct{}
+	wg         sync.WaitGroup
+}
+
+// New validates the rules. Command actions can run the given commands
+func New(publisher Publisher, store *state.Store, commandsCh, botCh chan<- her.Message, confs []her.RuleConf, commands []her.CommandConf) (*Engine, error) {
+	e := &Engine{
+		publisher:  publisher,
+		store:      store,
+		commandsCh: commandsCh,
+		botCh:      botCh,
+		commands:   make(map[string]her.CommandConf),
+		timers:     make(map[*trigger]*time.Timer),
+		stop:       make(chan struct{}),
+	}
+	for _, c := range commands {
+		e.commands[c.Command] = c
+	}
+
+	names := make(map[string]bool)
+	for _, conf := range confs {
+		if names[conf.Name] {
+			return nil, fmt.Errorf("duplicated rule %s", conf.Name)
+		}
+		names[conf.Name] = true
+
+		r, err := e.compile(conf)
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: %w", conf.Name, err)
+		}
+		e.rules = append(e.rules, r)
+	}
+	return e, nil
+}
+
+func (e *Engine) compile(conf her.RuleConf) (*rule, error) {
+	if conf.Name == "" {
+		return nil, errors.New("missing name")
+	}
+	if len(conf.Triggers) == 0 {
+		return nil, errors.New("missing triggers")
+	}
+	if len(conf.Actions) == 0 {
+		return nil, errors.New("missing actions")
+	}
+	if conf.Cooldown < 0 {
+		return nil, errors.New("negative cooldown")
+	}
+
+	r := &rule{conf: conf, notify: make(map[int]*template.Template), published: make(map[string]time.Time)}
+	for _, tc := range conf.Triggers {
+		t, err := compileTrigger(tc)
+		if err != nil {
+			return nil, err
+		}
+		r.triggers = append(r.triggers, t)
+	}
+	if conf.When != nil {
+		when, err := alarm.CompileExpr(*conf.When)
+		if err != nil {
+			return nil, err
+		}
+		r.when = when
+	}
+
+	for i, a := range conf.Actions {
+		kinds := 0
+		for _, set := range []bool{a.Publish != "", a.Notify != "", a.Delay != 0, a.Command != ""} {
+			if set {
+				kinds++
+			}
+		}
+		if kinds != 1 {
+			return nil, errors.New("each action needs exactly one of publish, notify, delay and command")
+		}
+		if a.Message != "" && a.Publish == "" {
+			return nil, errors.New("only publish actions have a message")
+		}
+		if !her.ValidQoS(a.QoS) {
+			return nil, fmt.Errorf("invalid qos %d", *a.QoS)
+		}
+		switch {
+		case a.Delay < 0:
+			return nil, errors.New("negative delay")
+		case a.Command != "":
+			if _, ok := e.commands[a.Command]; !ok {
+				return nil, fmt.Errorf("unknown command %s", a.Command)
+			}
+		case a.Notify != "":
+			tpl, err := template.New(conf.Name).Option("missingkey=error").Parse(a.Notify)
+			if err != nil {
+				return nil, err
+			}
+			r.notify[i] = tpl
+		}
+	}
+	return r, nil
+}
+
+// Handle runs the rules triggered by the event. It's called by the MQTT client and doesn't block
+func (e *Engine) Handle(event her.Event) {
+	for _, r := range e.rules {
+		for _, t := range r.triggers {
+			if t.matches(event) {
+				e.fire(r, Data{Rule: r.conf.Name, Key: event.Key, Value: event.Value, Alarm: event.Alarm, Time: time.Now()})
+				break
+			}
+		}
+	}
+}
+
+// Start schedules the triggers at the times of the day
+func (e *Engine) Start() {
+	for _, r := range e.rules {
+		for _, t := range r.triggers {
+			if t.scheduled {
+				e.schedule(r, t)
+			}
+		}
+	}
+}
+
+// schedule starts the timer of the trigger, or resets it after it fired
+func (e *Engine) schedule(r *rule, t *trigger) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.stopped() {
+		return
+	}
+	d := time.Until(t.next(time.Now()))
+	if timer, ok := e.timers[t]; ok {
+		timer.Reset(d)
+		return
+	}
+	e.timers[t] = time.AfterFunc(d, func() {
+		e.fire(r, Data{Rule: r.conf.Name, Time: time.Now()})
+		e.schedule(r, t)
+	})
+}
+
+// Stop cancels the scheduled triggers and the delayed actions, waiting for the running rules. No
+// rule runs after it returns, so the channels can be closed
+func (e *Engine) Stop() {
+	e.mu.Lock()
+	close(e.stop)
+	for t, timer := range e.timers {
+		timer.Stop()
+		delete(e.timers, t)
+	}
+	e.mu.Unlock()
+
+	e.wg.Wait()
+}
+
+func (e *Engine) stopped() bool {
+	select {
+	case <-e.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// fire runs the rule in the background, unless it's cooling down, it has been triggered by its own
+// publication or it's suspended for running too often
+func (e *Engine) fire(r *rule, data Data) {
+	// Holding the lock, Stop can't start waiting before the run is added to wg
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.stopped() {
+		return
+	}
+
+	ok, warning := r.start(data)
+	if warning != "" {
+		e.wg.Add(1)
+		go func() {
+			defer e.wg.Done()
+			e.notify(warning)
+		}()
+	}
+	if !ok {
+		return
+	}
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		e.run(r, data)
+	}()
+}
+
+// start records the run of the rule, returning false if the rule must not run and, when it gets
+// suspended, the warning for the bot
+func (r *rule) start(data Data) (bool, string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := data.Time
+	if now.Before(r.suspendedUntil) {
+		log.Debugf("Rule %s is suspended", r.conf.Name)
+		return false, ""
+	}
+	if data.Alarm == "" && data.Key != "" {
+		for topic, at := range r.published {
+			if now.Sub(at) > echoWindow {
+				delete(r.published, topic)
+				continue
+			}
+			if data.Key == topic || strings.HasPrefix(data.Key, topic+":") {
+				log.Debugf("Rule %s ignores its own publication on %s", r.conf.Name, topic)
+				return false, ""
+			}
+		}
+	}
+	if n := len(r.runs); n > 0 && now.Sub(r.runs[n-1]) < r.conf.Cooldown {
+		log.Debugf("Rule %s is cooling down", r.conf.Name)
+		return false, ""
+	}
+
+	runs := r.runs[:0]
+	for _, at := range r.runs {
+		if now.Sub(at) < loopWindow {
+			runs = append(runs, at)
+		}
+	}
+	r.runs = runs
+	if len(r.runs) >= loopRuns {
+		r.suspendedUntil = now.Add(loopWindow)
+		r.runs = nil
+		text := fmt.Sprintf("Rule %s ran %d times in %s, it may be a loop: suspended for %s", r.conf.Name, loopRuns, loopWindow, loopWindow)
+		log.Warning(text)
+		return false, text
+	}
+	r.runs = append(r.runs, now)
+	return true, ""
+}
+
+// run checks the condition of the rule and runs its actions in order, stopping at the first error
+func (e *Engine) run(r *rule, data Data) {
+	if r.when != nil {
+		ok, err := r.when.Evaluate(func(key string) (alarm.Value, bool) {
+			entry, ok := e.store.Get(key)
+			return alarm.Value{Raw: entry.Raw, Converted: entry.Converted}, ok
+		})
+		if err != nil || !ok {
+			log.Debugf("Rule %s skipped, condition not met (%v)", r.conf.Name, err)
+			return
+		}
+	}
+
+	log.Info("Running rule ", r.conf.Name)
+	for i, a := range r.conf.Actions {
+		if err := e.runAction(r, i, a, data); err != nil {
+			log.Errorf("Rule %s: %v", r.conf.Name, err)
+			return
+		}
+	}
+}
+
+func (e *Engine) runAction(r *rule, i int, a her.ActionConf, data Data) error {
+	dryRun := ""
+	if r.conf.DryRun {
+		dryRun = "[dry run] "
+	}
+
+	switch {
+	case a.Publish != "":
+		log.Infof("%sRule %s publishes %s to %s", dryRun, r.conf.Name, a.Message, a.Publish)
+		if r.conf.DryRun {
+			return nil
+		}
+		r.mu.Lock()
+		r.published[a.Publish] = time.Now()
+		r.mu.Unlock()
+		result := e.publisher.PublishOrQueue(her.Message{Topic: a.Publish, Message: []byte(a.Message), QoS: a.QoS, Retain: a.Retain})
+		switch result.Status {
+		case her.Failed:
+			return fmt.Errorf("cannot publish to %s: %v", a.Publish, result.Err)
+		case her.Queued:
+			log.Warningf("Rule %s: broker unreachable, the message to %s is queued", r.conf.Name, a.Publish)
+		}
+		return nil
+
+	case a.Notify != "":
+		var b bytes.Buffer
+		if err := r.notify[i].Execute(&b, data); err != nil {
+			return err
+		}
+		log.Infof("%sRule %s notifies %s", dryRun, r.conf.Name, b.String())
+		if r.conf.DryRun {
+			return nil
+		}
+		return e.send(e.botCh, her.Message{Topic: r.conf.Name, Message: b.Bytes(), Text: b.String(), ChatID: a.ChatID})
+
+	case a.Delay != 0:
+		log.Infof("%sRule %s waits %s", dryRun, r.conf.Name, a.Delay)
+		if r.conf.DryRun {
+			return nil
+		}
+		select {
+		case <-time.After(a.Delay):
+			return nil
+		case <-e.stop:
+			return errors.New("stopped while waiting")
+		}
+
+	default:
+		cmd := e.commands[a.Command]
+		log.Infof("%sRule %s runs /%s", dryRun, r.conf.Name, a.Command)
+		if r.conf.DryRun {
+			return nil
+		}
+		confirmation := cmd.Confirmation()
+		timeout := resultTimeout
+		if confirmation != nil {
+			timeout += confirmation.Timeout
+		}
+		result := make(chan her.PublishResult, 1)
+		msg := her.Message{Topic: cmd.Topic, Message: []byte(cmd.Message), QoS: cmd.QoS, Retain: cmd.Retain, Result: result, Confirm: confirmation}
+		if err := e.send(e.commandsCh, msg); err != nil {
+			return err
+		}
+		select {
+		case res := <-result:
+			if res.Status == her.Failed {
+				return fmt.Errorf("cannot run /%s: %v", a.Command, res.Err)
+			}
+			if confirmation != nil && !res.Confirmed {
+				return fmt.Errorf("no confirmation of /%s after %s", a.Command, confirmation.Timeout)
+			}
+			return nil
+		case <-time.After(timeout):
+			return fmt.Errorf("no answer from the broker for /%s", a.Command)
+		case <-e.stop:
+			return errors.New("stopped while waiting")
+		}
+	}
+}
+
+// send sends the message to the channel, giving up if the engine stops
+func (e *Engine) send(ch chan<- her.Message, msg her.Message) error {
+	select {
+	case ch <- msg:
+		return nil
+	case <-e.stop:
+		return errors.New("stopped while sending")
+	}
+}
+
+// notify tells the bot about the rules themselves
+func (e *Engine) notify(text string) {
+	if err := e.send(e.botCh, her.Message{Topic: "rules", Message: []byte(text), Text: text}); err != nil {
+		log.Error(err)
+	}
+}
@@ -0,0 +1,295 @@
+package rules
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tommyblue/her/her"
+	"github.com/tommyblue/her/state"
+)
+
+type publisherMock struct {
+	mu        sync.Mutex
+	published []string
+}
+
+func (p *publisherMock) PublishOrQueue(msg her.Message) her.PublishResult {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.published = append(p.published, fmt.Sprintf("%s=%s", msg.Topic, msg.Message))
+	return her.PublishResult{Status: her.Published}
+}
+
+func (p *publisherMock) get() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.published...)
+}
+
+var light = her.ActionConf{Publish: "hallway/light/set", Message: "ON"}
+
+func TestNew(t *testing.T) {
+	motion := her.TriggerConf{Topic: "hallway/motion"}
+	tests := []struct {
+		name string
+		conf her.RuleConf
+	}{
+		{"missing name", her.RuleConf{Triggers: []her.TriggerConf{motion}, Actions: []her.ActionConf{light}}},
+		{"missing triggers", her.RuleConf{Name: "r", Actions: []her.ActionConf{light}}},
+		{"missing actions", her.RuleConf{Name: "r", Triggers: []her.TriggerConf{motion}}},
+		{"two kinds of trigger", her.RuleConf{Name: "r", Triggers: []her.TriggerConf{{Topic: "a", At: "07:00"}}, Actions: []her.ActionConf{light}}},
+		{"invalid time", her.RuleConf{Name: "r", Triggers: []her.TriggerConf{{At: "7am"}}, Actions: []her.ActionConf{light}}},
+		{"operator of an alarm", her.RuleConf{Name: "r", Triggers: []her.TriggerConf{{Alarm: "leak", Operator: "equals"}}, Actions: []her.ActionConf{light}}},
+		{"invalid operator", her.RuleConf{Name: "r", Triggers: []her.TriggerConf{{Topic: "a", Operator: "bigger_than"}}, Actions: []her.ActionConf{light}}},
+		{"invalid condition", her.RuleConf{Name: "r", Triggers: []her.TriggerConf{motion}, When: &her.ExprConf{}, Actions: []her.ActionConf{light}}},
+		{"two kinds of action", her.RuleConf{Name: "r", Triggers: []her.TriggerConf{motion}, Actions: []her.ActionConf{{Publish: "a", Notify: "b"}}}},
+		{"unknown command", her.RuleConf{Name: "r", Triggers: []her.TriggerConf{motion}, Actions: []her.ActionConf{{Command: "off"}}}},
+		{"invalid template", her.RuleConf{Name: "r", Triggers: []her.TriggerConf{motion}, Actions: []her.ActionConf{{Notify: "{{.Value"}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := New(&publisherMock{}, state.NewStore(), nil, nil, []her.RuleConf{tt.conf}, []her.CommandConf{{Command: "on"}}); err == nil {
+				t.Error("Expected error")
+			}
+		})
+	}
+
+	rule := her.RuleConf{Name: "r", Triggers: []her.TriggerConf{motion}, Actions: []her.ActionConf{light}}
+	if _, err := New(&publisherMock{}, state.NewStore(), nil, nil, []her.RuleConf{rule, rule}, nil); err == nil {
+		t.Error("Expected error for duplicated rules")
+	}
+}
+
+func TestTriggerMatches(t *testing.T) {
+	tests := []struct {
+		conf  her.TriggerConf
+		event her.Event
+		want  bool
+	}{
+		{her.TriggerConf{Topic: "motion"}, her.Event{Key: "motion", Value: "OFF"}, true},
+		{her.TriggerConf{Topic: "motion"}, her.Event{Key: "door", Value: "ON"}, false},
+		{her.TriggerConf{Topic: "motion", Operator: "equals", Text: "ON"}, her.Event{Key: "motion", Value: "off", Raw: "OFF"}, false},
+		{her.TriggerConf{Topic: "motion", Operator: "equals", Text: "ON"}, her.Event{Key: "motion", Value: "detected", Raw: "ON"}, true},
+		{her.TriggerConf{Topic: "power", Operator: "greater_than", Value: 3000}, her.Event{Key: "power", Value: "3000", Converted: "3000.4"}, true},
+		{her.TriggerConf{Topic: "power", Operator: "greater_than", Value: 3000}, her.Event{Key: "power", Value: "n/a", Raw: "n/a", Converted: "n/a"}, false},
+		{her.TriggerConf{Topic: "bathroom"}, her.Event{Key: "bathroom", Value: "wet", Alarm: "leak"}, false},
+		{her.TriggerConf{Alarm: "leak"}, her.Event{Key: "bathroom", Value: "wet", Alarm: "leak"}, true},
+		{her.TriggerConf{Alarm: "bathroom#leak"}, her.Event{Key: "bathroom", Value: "wet", Alarm: "leak"}, true},
+		{her.TriggerConf{Alarm: "kitchen#leak"}, her.Event{Key: "bathroom", Value: "wet", Alarm: "leak"}, false},
+	}
+	for _, tt := range tests {
+		trigger, err := compileTrigger(tt.conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := trigger.matches(tt.event); got != tt.want {
+			t.Errorf("%+v matches %+v = %v, want %v", tt.conf, tt.event, got, tt.want)
+		}
+	}
+}
+
+func TestTriggerNext(t *testing.T) {
+	trigger, err := compileTrigger(her.TriggerConf{At: "07:30", Timezone: "UTC"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2023, 1, 1, 7, 0, 0, 0, time.UTC)
+	if got := trigger.next(now); !got.Equal(time.Date(2023, 1, 1, 7, 30, 0, 0, time.UTC)) {
+		t.Errorf("unexpected next %v", got)
+	}
+	if got := trigger.next(now.Add(30 * time.Minute)); !got.Equal(time.Date(2023, 1, 2, 7, 30, 0, 0, time.UTC)) {
+		t.Errorf("unexpected next %v", got)
+	}
+
+	rome, err := time.LoadLocation("Europe/Rome")
+	if err != nil {
+		t.Skip(err)
+	}
+	trigger, err = compileTrigger(her.TriggerConf{At: "07:30", Timezone: "Europe/Rome"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The clocks go back at 03:00 on the last Sunday of October
+	now = time.Date(2023, 10, 29, 1, 0, 0, 0, rome)
+	if got := trigger.next(now); !got.Equal(time.Date(2023, 10, 29, 7, 30, 0, 0, rome)) {
+		t.Errorf("unexpected next %v", got)
+	}
+}
+
+func TestRun(t *testing.T) {
+	store := state.NewStore()
+	publisher := &publisherMock{}
+	botCh := make(chan her.Message, 10)
+	commandsCh := make(chan her.Message, 10)
+	confs := []her.RuleConf{
+		{
+			Name:     "hallway_light",
+			Triggers: []her.TriggerConf{{Topic: "hallway/motion", Operator: "equals", Text: "ON"}},
+			When:     &her.ExprConf{Topic: "presence", Operator: "equals", Text: "away"},
+			Actions: []her.ActionConf{
+				light,
+				{Notify: "{{.Rule}}: motion is {{.Value}}"},
+				{Command: "camera"},
+			},
+		},
+		{
+			Name:     "dry",
+			Triggers: []her.TriggerConf{{Alarm: "leak"}},
+			Actions:  []her.ActionConf{{Publish: "valve/set", Message: "CLOSE"}, {Delay: time.Hour}},
+			DryRun:   true,
+		},
+	}
+	engine, err := New(publisher, store, commandsCh, botCh, confs, []her.CommandConf{{Command: "camera", Topic: "camera/snapshot", Message: "1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The condition isn't met
+	store.Update("presence", "presence", "Presence", "home", "", time.Now())
+	store.SetRaw("presence", "home", "home")
+	engine.Handle(her.Event{Key: "hallway/motion", Value: "ON", Raw: "ON"})
+	engine.wg.Wait()
+	if got := publisher.get(); len(got) != 0 {
+		t.Fatalf("Unexpected publications %v", got)
+	}
+
+	store.Update("presence", "presence", "Presence", "away", "", time.Now())
+	store.SetRaw("presence", "away", "away")
+	engine.Handle(her.Event{Key: "hallway/motion", Value: "ON", Raw: "ON"})
+	cmd := <-commandsCh
+	if cmd.Topic != "camera/snapshot" || string(cmd.Message) != "1" {
+		t.Errorf("unexpected command %+v", cmd)
+	}
+	cmd.Result <- her.PublishResult{Status: her.Published}
+	engine.wg.Wait()
+	if got := fmt.Sprint(publisher.get()); got != "[hallway/light/set=ON]" {
+		t.Errorf("unexpected publications %s", got)
+	}
+	if msg := <-botCh; msg.Text != "hallway_light: motion is ON" {
+		t.Errorf("unexpected notification %q", msg.Text)
+	}
+
+	// Dry runs only log the actions, without waiting
+	engine.Handle(her.Event{Key: "bathroom", Value: "wet", Alarm: "leak"})
+	engine.wg.Wait()
+	if got := fmt.Sprint(publisher.get()); got != "[hallway/light/set=ON]" {
+		t.Errorf("unexpected publications %s", got)
+	}
+
+	engine.Stop()
+	engine.Handle(her.Event{Key: "hallway/motion", Value: "ON", Raw: "ON"})
+	if len(commandsCh) != 0 || len(botCh) != 0 {
+		t.Error("Stopped rules must not run")
+	}
+}
+
+func TestLoopProtection(t *testing.T) {
+	publisher := &publisherMock{}
+	botCh := make(chan her.Message, 10)
+	confs := []her.RuleConf{{
+		Name:     "toggle",
+		Triggers: []her.TriggerConf{{Topic: "switch"}},
+		Actions:  []her.ActionConf{{Publish: "switch", Message: "ON"}},
+	}}
+	engine, err := New(publisher, state.NewStore(), nil, botCh, confs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := engine.rules[0]
+
+	// The echo of its own publication doesn't trigger the rule again
+	engine.Handle(her.Event{Key: "switch", Value: "OFF"})
+	engine.wg.Wait()
+	engine.Handle(her.Event{Key: "switch", Value: "ON"})
+	engine.wg.Wait()
+	if got := publisher.get(); len(got) != 1 {
+		t.Errorf("unexpected publications %v", got)
+	}
+
+	// Too many runs suspend the rule
+	now := time.Now()
+	for i := 0; i < loopRuns-1; i++ {
+		if ok, _ := r.start(Data{Time: now}); !ok {
+			t.Fatalf("Run %d not started", i)
+		}
+	}
+	ok, warning := r.start(Data{Time: now})
+	if ok || warning == "" {
+		t.Errorf("The rule must be suspended, got %v %q", ok, warning)
+	}
+	if ok, _ := r.start(Data{Time: now.Add(loopWindow / 2)}); ok {
+		t.Error("The rule must stay suspended")
+	}
+	if ok, _ := r.start(Data{Time: now.Add(loopWindow)}); !ok {
+		t.Error("The rule must run again after the suspension")
+	}
+}
+
+func TestCooldown(t *testing.T) {
+	confs := []her.RuleConf{{
+		Name:     "doorbell",
+		Triggers: []her.TriggerConf{{Topic: "doorbell"}},
+		Actions:  []her.ActionConf{{Notify: "Ding dong"}},
+		Cooldown: time.Minute,
+	}}
+	engine, err := New(&publisherMock{}, state.NewStore(), nil, nil, confs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := engine.rules[0]
+	now := time.Now()
+	if ok, _ := r.start(Data{Time: now}); !ok {
+		t.Fatal("Rule not started")
+	}
+	if ok, _ := r.start(Data{Time: now.Add(30 * time.Second)}); ok {
+		t.Error("The rule must cool down")
+	}
+	if ok, _ := r.start(Data{Time: now.Add(time.Minute)}); !ok {
+		t.Error("The rule must run after the cooldown")
+	}
+}
+
+func TestStop(t *testing.T) {
+	botCh := make(chan her.Message, 10)
+	confs := []her.RuleConf{{
+		Name:     "doorbell",
+		Triggers: []her.TriggerConf{{Topic: "doorbell"}, {At: "07:00"}},
+		Actions:  []her.ActionConf{{Publish: "chime/set", Message: "ON"}, {Notify: "Ding dong"}},
+	}}
+	engine, err := New(&publisherMock{}, state.NewStore(), nil, botCh, confs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine.Start()
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					engine.Handle(her.Event{Key: "doorbell", Value: "ON"})
+				}
+			}
+		}()
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	engine.Stop()
+	// Sending on the closed channel panics if a rule runs after Stop
+	close(botCh)
+	time.Sleep(10 * time.Millisecond)
+	close(done)
+	wg.Wait()
+
+	if len(engine.timers) != 0 {
+		t.Error("Timers not stopped")
+	}
+}
@@ -0,0 +1,102 @@
+package rules
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/tommyblue/her/alarm"
+	"github.com/tommyblue/her/her"
+)
+
+// trigger is a validated trigger of a rule
+type trigger struct {
+	topic     string
+	condition *alarm.Condition // Compares the value of the topic, nil to match any value
+	alarm     string
+	hour      int // Time of the day of the scheduled triggers, not the time since midnight
+	minute    int // which differs on the days the clocks change
+	loc       *time.Location
+	scheduled bool
+}
+
+func compileTrigger(conf her.TriggerConf) (*trigger, error) {
+	kinds := 0
+	for _, set := range []bool{conf.Topic != "", conf.Alarm != "", conf.At != ""} {
+		if set {
+			kinds++
+		}
+	}
+	if kinds != 1 {
+		return nil, errors.New("each trigger needs exactly one of topic, alarm and at")
+	}
+	if conf.Operator != "" && conf.Topic == "" {
+		return nil, errors.New("only topic triggers compare the value")
+	}
+	if conf.Timezone != "" && conf.At == "" {
+		return nil, errors.New("only at triggers have a timezone")
+	}
+
+	t := &trigger{topic: conf.Topic, alarm: conf.Alarm}
+	switch {
+	case conf.Operator != "":
+		if alarm.RateOperator(conf.Operator) {
+			return nil, fmt.Errorf("topic %s: %s compares the history, not the value", conf.Topic, conf.Operator)
+		}
+		c, err := alarm.Compile(her.AlarmConf{
+			Operator: conf.Operator,
+			Value:    conf.Value,
+			Min:      conf.Min,
+			Max:      conf.Max,
+			Text:     conf.Text,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("topic %s: %w", conf.Topic, err)
+		}
+		t.condition = c
+	case conf.At != "":
+		at, err := time.Parse("15:04", conf.At)
+		if err != nil {
+			return nil, fmt.Errorf("invalid time %q, expected hh:mm", conf.At)
+		}
+		t.hour, t.minute = at.Hour(), at.Minute()
+		t.loc = time.Local
+		if conf.Timezone != "" {
+			if t.loc, err = time.LoadLocation(conf.Timezone); err != nil {
+				return nil, err
+			}
+		}
+		t.scheduled = true
+	}
+	return t, nil
+}
+
+// matches reports whether the event fires the trigger. Like the alarms, it compares the value
+// received rather than the displayed one. Values that can't be compared don't
+func (t *trigger) matches(event her.Event) bool {
+	if event.Alarm != "" {
+		return t.alarm == event.Alarm || t.alarm == her.AlarmID(event.Key, event.Alarm)
+	}
+	if t.topic == "" || t.topic != event.Key {
+		return false
+	}
+	if t.condition == nil {
+		return true
+	}
+	value := event.Raw
+	if t.condition.Numeric() {
+		value = event.Converted
+	}
+	ok, err := t.condition.Triggered(value)
+	return err == nil && ok
+}
+
+// next returns the first time of the day of the trigger after now
+func (t *trigger) next(now time.Time) time.Time {
+	now = now.In(t.loc)
+	next := time.Date(now.Year(), now.Month(), now.Day(), t.hour, t.minute, 0, 0, t.loc)
+	if !next.After(now) {
+		next = time.Date(now.Year(), now.Month(), now.Day()+1, t.hour, t.minute, 0, 0, t.loc)
+	}
+	return next
+}
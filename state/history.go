@@ -0,0 +1,36 @@
+package state
+
+import "time"
+
+// sample is a numeric value received at a given time
+type sample struct {
+	Value float64
+	At    time.Time
+}
+
+// Record adds the value to the history of the key, dropping the samples older than keep
+func (s *Store) Record(key string, value float64, at time.Time, keep time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	samples := append(s.history[key], sample{Value: value, At: at})
+	i := 0
+	for i < len(samples) && samples[i].At.Before(at.Add(-keep)) {
+		i++
+	}
+	s.history[key] = append(samples[:0], samples[i:]...)
+}
+
+// History returns the values of the key recorded since the given time, oldest first
+func (s *Store) History(key string, since time.Time) []float64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var values []float64
+	for _, h := range s.history[key] {
+		if !h.At.Before(since) {
+			values = append(values, h.Value)
+		}
+	}
+	return values
+}
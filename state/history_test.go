@@ -0,0 +1,29 @@
+package state
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestHistory(t *testing.T) {
+	s := NewStore()
+	start := time.Date(2023, 1, 1, 10, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		s.Record("k", float64(i), start.Add(time.Duration(i)*time.Minute), 2*time.Minute)
+	}
+
+	// Older samples are dropped
+	if got := fmt.Sprint(s.History("k", start)); got != "[2 3 4]" {
+		t.Errorf("unexpected history %s", got)
+	}
+	if got := fmt.Sprint(s.History("k", start.Add(3*time.Minute))); got != "[3 4]" {
+		t.Errorf("unexpected history %s", got)
+	}
+
+	s.Update("k", "topic", "Label", "4", "", start)
+	s.Delete("k")
+	if got := s.History("k", start); len(got) != 0 {
+		t.Errorf("History not deleted: %v", got)
+	}
+}
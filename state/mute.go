@@ -0,0 +1,73 @@
+package state
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// MuteAll is the target of the mutes silencing every subscription
+const MuteAll = "all"
+
+// Mute silences the notifications and the alarms of a subscription, or of all of them, for a while
+type Mute struct {
+	Target string    `json:"target"` // Label or topic of the subscription, or MuteAll
+	Until  time.Time `json:"until"`
+	By     string    `json:"by,omitempty"`
+}
+
+// Mute adds the mute, replacing the one with the same target
+func (s *Store) Mute(m Mute) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.mutes[strings.ToLower(m.Target)] = m
+}
+
+// Unmute removes the mute of the target, or all of them if the target is empty. It returns whether
+// any mute has been removed
+func (s *Store) Unmute(target string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if target == "" {
+		removed := len(s.mutes) > 0
+		s.mutes = make(map[string]Mute)
+		return removed
+	}
+	_, ok := s.mutes[strings.ToLower(target)]
+	delete(s.mutes, strings.ToLower(target))
+	return ok
+}
+
+// Mutes returns the mutes not expired yet, sorted by target
+func (s *Store) Mutes(now time.Time) []Mute {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	mutes := make([]Mute, 0, len(s.mutes))
+	for _, m := range s.mutes {
+		if m.Until.After(now) {
+			mutes = append(mutes, m)
+		}
+	}
+	sort.Slice(mutes, func(i, j int) bool { return mutes[i].Target < mutes[j].Target })
+	return mutes
+}
+
+// Muted reports whether a mute targeting all the subscriptions or one of the names, compared
+// ignoring the case, is active
+func (s *Store) Muted(now time.Time, names ...string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if m, ok := s.mutes[MuteAll]; ok && m.Until.After(now) {
+		return true
+	}
+	for _, name := range names {
+		if m, ok := s.mutes[strings.ToLower(name)]; ok && m.Until.After(now) {
+			return true
+		}
+	}
+	return false
+}
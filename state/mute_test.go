@@ -0,0 +1,42 @@
+package state
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMute(t *testing.T) {
+	s := NewStore()
+	now := time.Now()
+	s.Mute(Mute{Target: "Kitchen", Until: now.Add(time.Hour), By: "tommy"})
+	s.Mute(Mute{Target: "garage/door", Until: now.Add(-time.Minute)})
+
+	tests := []struct {
+		names []string
+		want  bool
+	}{
+		{[]string{"kitchen"}, true},
+		{[]string{"Bedroom", "sensor/kitchen"}, false},
+		{[]string{"garage/door"}, false}, // Expired
+		{nil, false},
+	}
+	for _, tt := range tests {
+		if got := s.Muted(now, tt.names...); got != tt.want {
+			t.Errorf("Muted(%v) = %v, want %v", tt.names, got, tt.want)
+		}
+	}
+	if mutes := s.Mutes(now); len(mutes) != 1 || mutes[0].Target != "Kitchen" {
+		t.Errorf("unexpected mutes %+v", mutes)
+	}
+
+	s.Mute(Mute{Target: MuteAll, Until: now.Add(time.Hour)})
+	if !s.Muted(now, "Bedroom") {
+		t.Error("Everything must be muted")
+	}
+	if !s.Unmute("ALL") || s.Unmute("all") {
+		t.Error("Unexpected unmute result")
+	}
+	if !s.Unmute("") || len(s.Mutes(now)) != 0 {
+		t.Error("Mutes not removed")
+	}
+}
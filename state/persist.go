@@ -0,0 +1,85 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// file is the content of the state file
+type file struct {
+	Entries []Entry `json:"entries"`
+	Mutes   []Mute  `json:"mutes,omitempty"`
+}
+
+// Save writes all the entries and the mutes not expired yet to the file
+func (s *Store) Save(path string) error {
+	data, err := json.MarshalIndent(file{Entries: s.Snapshot(), Mutes: s.Mutes(time.Now())}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := WriteFile(path, data); err != nil {
+		return fmt.Errorf("cannot save the state: %w", err)
+	}
+	return nil
+}
+
+// WriteFile replaces the file atomically, writing a temporary file and renaming it, so a crash while
+// saving never leaves a truncated file behind
+func WriteFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Load reads the entries and the mutes written by Save. Loaded values are marked stale since they
+// were received, until a fresh value arrives. A missing file is not an error, as it happens at the
+// first run
+func (s *Store) Load(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot load the state: %w", err)
+	}
+
+	var f file
+	if err := json.Unmarshal(data, &f); err != nil {
+		return fmt.Errorf("cannot load the state from %s: %w", path, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range f.Entries {
+		e := f.Entries[i]
+		if e.StaleSince.IsZero() {
+			e.StaleSince = e.ReceivedAt
+		}
+		s.entries[e.Key] = &e
+	}
+	for _, m := range f.Mutes {
+		s.mutes[strings.ToLower(m.Target)] = m
+	}
+	return nil
+}
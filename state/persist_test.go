@@ -0,0 +1,76 @@
+package state
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSaveLoad(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+	receivedAt := time.Date(2023, 1, 1, 10, 0, 0, 0, time.UTC)
+
+	s := NewStore()
+	s.Update("k", "topic", "Label", "21", "", receivedAt.Add(-time.Minute))
+	s.Update("k", "topic", "Label", "31", "", receivedAt)
+	s.SetAlarm("k", "high", Alarm{Active: true, Value: "31", TriggeredAt: receivedAt})
+	s.Mute(Mute{Target: "Label", Until: time.Now().Add(time.Hour), By: "tommy"})
+	s.Mute(Mute{Target: "expired", Until: time.Now().Add(-time.Hour)})
+	if err := s.Save(path); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	// Saving again must replace the file
+	if err := s.Save(path); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	files, _ := os.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("Temporary files left in the directory: %v", files)
+	}
+
+	loaded := NewStore()
+	if err := loaded.Load(path); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	e, ok := loaded.Get("k")
+	if !ok {
+		t.Fatalf("Entry not loaded")
+	}
+	if e.Value != "31" || e.Previous != "21" || e.Label != "Label" || !e.Alarms["high"].Active || e.Alarms["high"].Value != "31" {
+		t.Errorf("unexpected entry %+v", e)
+	}
+	if mutes := loaded.Mutes(time.Now()); len(mutes) != 1 || mutes[0].Target != "Label" || mutes[0].By != "tommy" {
+		t.Errorf("unexpected mutes %+v", mutes)
+	}
+	if !e.Stale() || !e.StaleSince.Equal(receivedAt) {
+		t.Errorf("Loaded entry must be stale since %v, got %v", receivedAt, e.StaleSince)
+	}
+
+	loaded.Update("k", "topic", "Label", "22", "", time.Now())
+	if e, _ := loaded.Get("k"); e.Stale() {
+		t.Errorf("Fresh entry must not be stale")
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	dir := t.TempDir()
+
+	if err := NewStore().Load(filepath.Join(dir, "missing.json")); err != nil {
+		t.Errorf("Missing file must not be an error, got %v", err)
+	}
+
+	invalid := filepath.Join(dir, "invalid.json")
+	if err := os.WriteFile(invalid, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewStore().Load(invalid); err == nil {
+		t.Errorf("Expected error")
+	}
+
+	if err := NewStore().Save(filepath.Join(dir, "missing", "state.json")); err == nil {
+		t.Errorf("Expected error")
+	}
+}
@@ -0,0 +1,216 @@
+package state
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tommyblue/her/her"
+)
+
+// Entry is the last known state of a subscription on a concrete topic
+type Entry struct {
+	Key        string           `json:"key"`
+	Topic      string           `json:"topic"`
+	Label      string           `json:"label"`
+	Value      string           `json:"value"`               // Formatted with the subscription values map and precision
+	Raw        string           `json:"raw,omitempty"`       // The payload, compared by the string operators
+	Converted  string           `json:"converted,omitempty"` // After scale and offset, compared by the numeric operators
+	Unit       string           `json:"unit,omitempty"`
+	ReceivedAt time.Time        `json:"received_at"`
+	Previous   string           `json:"previous,omitempty"`
+	PreviousAt time.Time        `json:"previous_at,omitempty"`
+	StaleSince time.Time        `json:"stale_since,omitempty"` // Set when the value may be outdated
+	Alarms     map[string]Alarm `json:"alarms,omitempty"`      // By alarm name
+	StatusLine string           `json:"status_line,omitempty"` // The value formatted for /status
+}
+
+// Stale reports whether the value may be outdated, i.e. nothing has been received since it was
+// loaded from a previous run or for longer than the subscription max_silence
+func (e Entry) Stale() bool {
+	return !e.StaleSince.IsZero()
+}
+
+// Severity returns the worst severity among the active alarms, empty if none is active
+func (e Entry) Severity() string {
+	severity := ""
+	for _, a := range e.Alarms {
+		if a.Active && her.SeverityRank(a.Severity) > her.SeverityRank(severity) {
+			severity = a.Severity
+		}
+	}
+	return severity
+}
+
+// clone copies the entry, so that it can be read without holding the lock
+func (e *Entry) clone() Entry {
+	c := *e
+	if e.Alarms != nil {
+		c.Alarms = make(map[string]Alarm, len(e.Alarms))
+		for name, a := range e.Alarms {
+			c.Alarms[name] = a
+		}
+	}
+	return c
+}
+
+// Alarm is the alarm state of an entry. Value is the value that last triggered the alarm
+type Alarm struct {
+	Active      bool      `json:"active"`
+	Severity    string    `json:"severity,omitempty"`
+	Value       string    `json:"value,omitempty"`
+	TriggeredAt time.Time `json:"triggered_at,omitempty"`
+	ClearedAt   time.Time `json:"cleared_at,omitempty"`
+	AckedBy     string    `json:"acked_by,omitempty"` // Who acknowledged the alarm, if anyone did
+	AckedAt     time.Time `json:"acked_at,omitempty"`
+}
+
+// Acked reports whether the alarm has been acknowledged since it was triggered
+func (a Alarm) Acked() bool {
+	return !a.AckedAt.IsZero()
+}
+
+// Store keeps the state of all the subscriptions and can be safely shared between goroutines
+type Store struct {
+	mu      sync.RWMutex
+	entries map[string]*Entry
+	history map[string][]sample // Recent numeric values by key, not persisted
+	mutes   map[string]Mute     // By lowercase target
+}
+
+func NewStore() *Store {
+	return &Store{
+		entries: make(map[string]*Entry),
+		history: make(map[string][]sample),
+		mutes:   make(map[string]Mute),
+	}
+}
+
+// Update records the value received for the key, returning the entry as it was before the update
+// and whether it existed
+func (s *Store) Update(key, topic, label, value, unit string, at time.Time) (Entry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.entries[key]
+	if !ok {
+		e = &Entry{Key: key}
+		s.entries[key] = e
+	}
+	prev := e.clone()
+
+	e.Topic = topic
+	e.Label = label
+	if ok {
+		e.Previous = e.Value
+		e.PreviousAt = e.ReceivedAt
+	}
+	e.Value = value
+	e.Unit = unit
+	e.ReceivedAt = at
+	e.StaleSince = time.Time{}
+
+	return prev, ok
+}
+
+func (s *Store) Get(key string) (Entry, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	e, ok := s.entries[key]
+	if !ok {
+		return Entry{}, false
+	}
+	return e.clone(), true
+}
+
+// SetAlarm replaces the state of the named alarm of an existing key
+func (s *Store) SetAlarm(key, name string, alarm Alarm) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.entries[key]; ok {
+		if e.Alarms == nil {
+			e.Alarms = make(map[string]Alarm)
+		}
+		e.Alarms[name] = alarm
+	}
+}
+
+// SetRaw sets the values compared by the alarms and the conditions of an existing key
+func (s *Store) SetRaw(key, raw, converted string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.entries[key]; ok {
+		e.Raw = raw
+		e.Converted = converted
+	}
+}
+
+// SetStatusLine replaces the status line of an existing key
+func (s *Store) SetStatusLine(key, line string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.entries[key]; ok {
+		e.StatusLine = line
+	}
+}
+
+// Ack acknowledges the named alarm of the key, returning false if it's not active or already
+// acknowledged
+func (s *Store) Ack(key, name, by string, at time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.entries[key]
+	if !ok {
+		return false
+	}
+	a, ok := e.Alarms[name]
+	if !ok || !a.Active || a.Acked() {
+		return false
+	}
+	a.AckedBy = by
+	a.AckedAt = at
+	e.Alarms[name] = a
+	return true
+}
+
+// MarkStale marks the value of an existing key as outdated since the given time, unless it already is
+func (s *Store) MarkStale(key string, since time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.entries[key]; ok && e.StaleSince.IsZero() {
+		e.StaleSince = since
+	}
+}
+
+// Delete forgets the key
+func (s *Store) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.entries, key)
+	delete(s.history, key)
+}
+
+// Snapshot returns a copy of all the entries, sorted by label and key
+func (s *Store) Snapshot() []Entry {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entries := make([]Entry, 0, len(s.entries))
+	for _, e := range s.entries {
+		entries = append(entries, e.clone())
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Label != entries[j].Label {
+			return entries[i].Label < entries[j].Label
+		}
+		return entries[i].Key < entries[j].Key
+	})
+	return entries
+}
@@ -0,0 +1,135 @@
+package state
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUpdate(t *testing.T) {
+	s := NewStore()
+	t1 := time.Date(2023, 1, 1, 10, 0, 0, 0, time.UTC)
+	t2 := t1.Add(time.Minute)
+
+	if _, ok := s.Update("k", "topic", "Label", "21", "", t1); ok {
+		t.Errorf("Key must not exist before the first update")
+	}
+	prev, ok := s.Update("k", "topic", "Label", "22", "", t2)
+	if !ok || prev.Value != "21" || !prev.ReceivedAt.Equal(t1) {
+		t.Errorf("unexpected previous entry %+v", prev)
+	}
+
+	e, ok := s.Get("k")
+	if !ok {
+		t.Fatalf("Key not found")
+	}
+	if e.Value != "22" || e.Previous != "21" || !e.ReceivedAt.Equal(t2) || !e.PreviousAt.Equal(t1) {
+		t.Errorf("unexpected entry %+v", e)
+	}
+
+	s.SetAlarm("k", "warning", Alarm{Active: true, Severity: "warning", Value: "22", TriggeredAt: t2})
+	if e, _ := s.Get("k"); !e.Alarms["warning"].Active || e.Alarms["warning"].Value != "22" {
+		t.Errorf("alarm not set %+v", e.Alarms)
+	}
+
+	s.SetAlarm("missing", "warning", Alarm{Active: true})
+	if _, ok := s.Get("missing"); ok {
+		t.Errorf("SetAlarm must not create entries")
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	s := NewStore()
+	now := time.Now()
+	s.Update("b", "b", "Kitchen", "1", "", now)
+	s.Update("a", "a", "Bedroom", "2", "", now)
+	s.Update("c", "c", "Kitchen", "3", "", now)
+
+	var got []string
+	for _, e := range s.Snapshot() {
+		got = append(got, e.Key)
+	}
+	if fmt.Sprint(got) != "[a b c]" {
+		t.Errorf("unexpected order %v", got)
+	}
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	s := NewStore()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			s.Update(fmt.Sprint(i%3), "topic", "label", fmt.Sprint(i), "", time.Now())
+		}(i)
+		go func() {
+			defer wg.Done()
+			_ = s.Snapshot()
+		}()
+	}
+	wg.Wait()
+
+	if len(s.Snapshot()) != 3 {
+		t.Errorf("unexpected number of entries")
+	}
+}
+
+func TestSeverity(t *testing.T) {
+	s := NewStore()
+	s.Update("k", "topic", "Label", "31", "", time.Now())
+	if e, _ := s.Get("k"); e.Severity() != "" {
+		t.Errorf("unexpected severity %q", e.Severity())
+	}
+
+	s.SetAlarm("k", "warm", Alarm{Active: true, Severity: "warning"})
+	s.SetAlarm("k", "hot", Alarm{Active: true, Severity: "critical"})
+	s.SetAlarm("k", "cold", Alarm{Active: false, Severity: "critical"})
+	e, _ := s.Get("k")
+	if e.Severity() != "critical" {
+		t.Errorf("unexpected severity %q", e.Severity())
+	}
+
+	// Entries are copies
+	e.Alarms["hot"] = Alarm{}
+	if e, _ := s.Get("k"); !e.Alarms["hot"].Active {
+		t.Error("the entry alarms must not be shared")
+	}
+}
+
+func TestAck(t *testing.T) {
+	s := NewStore()
+	s.Update("k", "topic", "Label", "31", "", time.Now())
+	if s.Ack("k", "hot", "tommy", time.Now()) {
+		t.Error("Missing alarms can't be acknowledged")
+	}
+
+	s.SetAlarm("k", "hot", Alarm{Active: true, Severity: "critical"})
+	at := time.Now()
+	if !s.Ack("k", "hot", "tommy", at) {
+		t.Fatal("Alarm not acknowledged")
+	}
+	if e, _ := s.Get("k"); e.Alarms["hot"].AckedBy != "tommy" || !e.Alarms["hot"].AckedAt.Equal(at) {
+		t.Errorf("unexpected alarm %+v", e.Alarms["hot"])
+	}
+	if s.Ack("k", "hot", "someone", time.Now()) {
+		t.Error("Alarms are acknowledged only once")
+	}
+}
+
+func TestMarkStale(t *testing.T) {
+	s := NewStore()
+	since := time.Date(2023, 1, 1, 10, 0, 0, 0, time.UTC)
+	s.Update("k", "topic", "Label", "21", "", since)
+	s.MarkStale("k", since)
+	s.MarkStale("k", since.Add(time.Hour))
+	if e, _ := s.Get("k"); !e.StaleSince.Equal(since) {
+		t.Errorf("unexpected stale since %v", e.StaleSince)
+	}
+
+	s.MarkStale("missing", since)
+	if _, ok := s.Get("missing"); ok {
+		t.Errorf("MarkStale must not create entries")
+	}
+}